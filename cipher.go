@@ -3,13 +3,32 @@ package stream
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+// keyUpdateInfo is the HKDF info used to derive the next key from the current
+// key during key update.
+const keyUpdateInfo = "encrypted-stream key update"
+
+// ErrKeyUpdateNotSupported indicates the cipher does not support key update,
+// e.g. a CryptoAEADCipher created by NewCryptoAEADCipher, whose key is unknown.
+var ErrKeyUpdateNotSupported = errors.New("cipher does not support key update")
+
+// ErrAdditionalDataNotSupported indicates the cipher does not implement
+// AdditionalDataCipher, which is required by Config.AuthenticateHeader.
+var ErrAdditionalDataNotSupported = errors.New("cipher does not support additional data")
+
+// ErrCipherDestroyed is returned by ciphers in this package after Destroy is
+// called.
+var ErrCipherDestroyed = errors.New("cipher is destroyed")
+
 // Cipher provides encrypt and decrypt function of a slice data.
 type Cipher interface {
 	// Encrypt encrypts a plaintext to ciphertext. Returns ciphertext slice
@@ -35,6 +54,105 @@ type Cipher interface {
 	NonceSize() int
 }
 
+// AdditionalDataCipher is an optional interface that can be implemented by
+// Cipher to authenticate additional data that is not encrypted, which is used
+// to authenticate the chunk length and header (see Config.AuthenticateHeader).
+// CryptoAEADCipher implements it.
+type AdditionalDataCipher interface {
+	Cipher
+
+	// EncryptWithAdditionalData is the same as Encrypt, but also authenticates
+	// additionalData. The length of returned ciphertext should be exactly
+	// len(plaintext) + MaxOverhead(), as it is authenticated before encryption.
+	EncryptWithAdditionalData(ciphertext, plaintext, nonce, additionalData []byte) ([]byte, error)
+
+	// DecryptWithAdditionalData is the same as Decrypt, but returns error if
+	// additionalData is different from the one used to encrypt.
+	DecryptWithAdditionalData(plaintext, ciphertext, nonce, additionalData []byte) ([]byte, error)
+}
+
+// supportsAdditionalData returns whether a cipher can be used with header
+// authentication.
+func supportsAdditionalData(c Cipher) bool {
+	switch c := c.(type) {
+	case *directionalCipher:
+		return supportsAdditionalData(c.encrypt) && supportsAdditionalData(c.decrypt)
+	case AdditionalDataCipher:
+		return true
+	default:
+		return false
+	}
+}
+
+// KeyUpdater is an optional interface that can be implemented by Cipher to
+// support key update (see Config.KeyUpdate).
+type KeyUpdater interface {
+	// UpdateKey returns a new Cipher of the same type whose key is derived from
+	// the current key and secret using a one-way function, so the current key
+	// can not be computed from the new one. Secret is mixed into the new key if
+	// it is not nil. The current Cipher should remain usable.
+	UpdateKey(secret []byte) (Cipher, error)
+}
+
+// Destroyer is an optional interface that can be implemented by Cipher to erase
+// its key material when it is no longer used, e.g. when the stream is closed
+// (see Config.DestroyCipher) or the key is updated. A Cipher can implement
+// io.Closer instead, whose Close is called in the same way. All ciphers in this
+// package implement Destroyer.
+type Destroyer interface {
+	// Destroy overwrites the key material held by the cipher with zeros and
+	// drops the references to it, after which Encrypt and Decrypt should return
+	// error. It should be safe to call Destroy (or Close) more than once.
+	Destroy()
+}
+
+// destroyCipher calls Destroy or Close of a cipher if it implements Destroyer
+// or io.Closer.
+func destroyCipher(c Cipher) error {
+	switch c := c.(type) {
+	case Destroyer:
+		c.Destroy()
+	case io.Closer:
+		return c.Close()
+	}
+	return nil
+}
+
+// nextKey derives the next key of the same size from the current key and an
+// optional secret using HKDF-SHA256.
+func nextKey(key, secret []byte) ([]byte, error) {
+	r := hkdf.New(sha256.New, key, secret, []byte(keyUpdateInfo))
+
+	b := make([]byte, len(key))
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// erase overwrites b with zeros.
+func erase(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// supportsKeyUpdate returns whether a cipher can be used with key update.
+func supportsKeyUpdate(c Cipher) bool {
+	switch c := c.(type) {
+	case *directionalCipher:
+		return supportsKeyUpdate(c.encrypt) && supportsKeyUpdate(c.decrypt)
+	case *CryptoAEADCipher:
+		return c.newAEAD != nil
+	case KeyUpdater:
+		return true
+	default:
+		return false
+	}
+}
+
 // XSalsa20Poly1305Cipher is an AEAD cipher that uses XSalsa20 and Poly1305 to
 // encrypt and authenticate messages. The ciphertext it produces contains 24
 // bytes of random nonce, followed by n+16 bytes of authenticated encrypted
@@ -44,7 +162,8 @@ type XSalsa20Poly1305Cipher struct {
 }
 
 // NewXSalsa20Poly1305Cipher creates a XSalsa20Poly1305Cipher with a given key.
-// For best security, every stream should have a unique key.
+// For best security, every stream should have a unique key. Key is not copied,
+// and is overwritten with zeros by Destroy.
 func NewXSalsa20Poly1305Cipher(key *[32]byte) *XSalsa20Poly1305Cipher {
 	return &XSalsa20Poly1305Cipher{
 		key: key,
@@ -53,6 +172,10 @@ func NewXSalsa20Poly1305Cipher(key *[32]byte) *XSalsa20Poly1305Cipher {
 
 // Encrypt implements Cipher.
 func (c *XSalsa20Poly1305Cipher) Encrypt(ciphertext, plaintext, nonce []byte) ([]byte, error) {
+	if c.key == nil {
+		return nil, ErrCipherDestroyed
+	}
+
 	var n [24]byte
 	copy(n[:], nonce[:24])
 
@@ -63,6 +186,10 @@ func (c *XSalsa20Poly1305Cipher) Encrypt(ciphertext, plaintext, nonce []byte) ([
 
 // Decrypt implements Cipher.
 func (c *XSalsa20Poly1305Cipher) Decrypt(plaintext, ciphertext, nonce []byte) ([]byte, error) {
+	if c.key == nil {
+		return nil, ErrCipherDestroyed
+	}
+
 	var n [24]byte
 	copy(n[:], nonce[:24])
 
@@ -89,28 +216,90 @@ func (c *XSalsa20Poly1305Cipher) NonceSize() int {
 	return 24
 }
 
+// UsageLimits implements UsageLimiter.
+func (c *XSalsa20Poly1305Cipher) UsageLimits(sequentialNonce bool) UsageLimits {
+	return extendedNonceUsageLimits
+}
+
+// UpdateKey implements KeyUpdater.
+func (c *XSalsa20Poly1305Cipher) UpdateKey(secret []byte) (Cipher, error) {
+	if c.key == nil {
+		return nil, ErrCipherDestroyed
+	}
+
+	key, err := nextKey(c.key[:], secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var k [32]byte
+	copy(k[:], key)
+
+	erase(key)
+
+	return NewXSalsa20Poly1305Cipher(&k), nil
+}
+
+// Destroy implements Destroyer. It overwrites the key passed to
+// NewXSalsa20Poly1305Cipher.
+func (c *XSalsa20Poly1305Cipher) Destroy() {
+	if c.key != nil {
+		*c.key = [32]byte{}
+		c.key = nil
+	}
+}
+
 // CryptoAEADCipher is a wrapper to crypto/cipher AEAD interface and implements
 // Cipher interface.
 type CryptoAEADCipher struct {
-	aead cipher.AEAD
+	aead      cipher.AEAD
+	limits    UsageLimits
+	nonceSize int
+	overhead  int
+
+	// key and newAEAD are only set when created from a key, and are used for
+	// key update.
+	key     []byte
+	newAEAD func([]byte) (cipher.AEAD, error)
 }
 
 // NewCryptoAEADCipher converts a crypto/cipher AEAD to Cipher.
 func NewCryptoAEADCipher(aead cipher.AEAD) *CryptoAEADCipher {
 	return &CryptoAEADCipher{
-		aead: aead,
+		aead:      aead,
+		limits:    defaultUsageLimits(aead.NonceSize()),
+		nonceSize: aead.NonceSize(),
+		overhead:  aead.Overhead(),
 	}
 }
 
 // Encrypt implements Cipher.
 func (c *CryptoAEADCipher) Encrypt(ciphertext, plaintext, nonce []byte) ([]byte, error) {
-	encrypted := c.aead.Seal(ciphertext[:0], nonce, plaintext, nil)
-	return ciphertext[:len(encrypted)], nil
+	return c.EncryptWithAdditionalData(ciphertext, plaintext, nonce, nil)
 }
 
 // Decrypt implements Cipher.
 func (c *CryptoAEADCipher) Decrypt(plaintext, ciphertext, nonce []byte) ([]byte, error) {
-	plaintext, err := c.aead.Open(plaintext[:0], nonce, ciphertext, nil)
+	return c.DecryptWithAdditionalData(plaintext, ciphertext, nonce, nil)
+}
+
+// EncryptWithAdditionalData implements AdditionalDataCipher.
+func (c *CryptoAEADCipher) EncryptWithAdditionalData(ciphertext, plaintext, nonce, additionalData []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, ErrCipherDestroyed
+	}
+
+	encrypted := c.aead.Seal(ciphertext[:0], nonce, plaintext, additionalData)
+	return ciphertext[:len(encrypted)], nil
+}
+
+// DecryptWithAdditionalData implements AdditionalDataCipher.
+func (c *CryptoAEADCipher) DecryptWithAdditionalData(plaintext, ciphertext, nonce, additionalData []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, ErrCipherDestroyed
+	}
+
+	plaintext, err := c.aead.Open(plaintext[:0], nonce, ciphertext, additionalData)
 	if err != nil {
 		return nil, fmt.Errorf("decrypt failed: %v", err)
 	}
@@ -118,56 +307,148 @@ func (c *CryptoAEADCipher) Decrypt(plaintext, ciphertext, nonce []byte) ([]byte,
 	return plaintext, nil
 }
 
-// overhead returns Cipher's overhead including nonce size.
-func (c *CryptoAEADCipher) overhead() int {
-	return c.aead.Overhead()
-}
-
 // MaxOverhead implements Cipher.
 func (c *CryptoAEADCipher) MaxOverhead() int {
-	return c.overhead()
+	return c.overhead
 }
 
 // NonceSize implements Cipher.
 func (c *CryptoAEADCipher) NonceSize() int {
-	return c.aead.NonceSize()
+	return c.nonceSize
 }
 
-// NewAESGCMCipher creates a 128-bit (16 bytes key) or 256-bit (32 bytes key)
-// AES block cipher wrapped in Galois Counter Mode with the standard nonce
-// length. For best security, every stream should have a unique key.
-func NewAESGCMCipher(key []byte) (*CryptoAEADCipher, error) {
-	block, err := aes.NewCipher(key)
+// UsageLimits implements UsageLimiter. Limits of a CryptoAEADCipher created by
+// NewCryptoAEADCipher are based on nonce size. The number of chunks is not
+// limited with sequential nonce, as nonces never collide, while other limits
+// do not depend on how nonces are chosen.
+func (c *CryptoAEADCipher) UsageLimits(sequentialNonce bool) UsageLimits {
+	limits := c.limits
+	if sequentialNonce {
+		limits.MaxChunks = 0
+	}
+	return limits
+}
+
+// UpdateKey implements KeyUpdater. Returns ErrKeyUpdateNotSupported if the
+// cipher is created by NewCryptoAEADCipher.
+func (c *CryptoAEADCipher) UpdateKey(secret []byte) (Cipher, error) {
+	if c.newAEAD == nil {
+		return nil, ErrKeyUpdateNotSupported
+	}
+
+	if c.aead == nil {
+		return nil, ErrCipherDestroyed
+	}
+
+	key, err := nextKey(c.key, secret)
 	if err != nil {
 		return nil, err
 	}
+	defer erase(key)
+
+	return newCryptoAEADCipherWithKey(key, c.newAEAD, c.limits)
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+// Destroy implements Destroyer. It overwrites the copy of key held by a
+// CryptoAEADCipher created from a key, and drops the reference to the AEAD.
+// Key material expanded by the AEAD (e.g. the AES key schedule) can not be
+// overwritten, and is released to the garbage collector.
+func (c *CryptoAEADCipher) Destroy() {
+	erase(c.key)
+	c.key = nil
+	c.aead = nil
+}
+
+// newCryptoAEADCipherWithKey creates a CryptoAEADCipher from a key and the
+// function that creates AEAD from key, which supports key update.
+func newCryptoAEADCipherWithKey(key []byte, newAEAD func([]byte) (cipher.AEAD, error), limits UsageLimits) (*CryptoAEADCipher, error) {
+	aead, err := newAEAD(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewCryptoAEADCipher(aesgcm), nil
+	return &CryptoAEADCipher{
+		aead:      aead,
+		limits:    limits,
+		nonceSize: aead.NonceSize(),
+		overhead:  aead.Overhead(),
+		key:       append([]byte(nil), key...),
+		newAEAD:   newAEAD,
+	}, nil
 }
 
-// NewChaCha20Poly1305Cipher creates a ChaCha20-Poly1305 AEAD that uses the
-// given 256-bit key.
-func NewChaCha20Poly1305Cipher(key []byte) (*CryptoAEADCipher, error) {
-	cipher, err := chacha20poly1305.New(key)
+// NewAESGCMCipher creates a 128-bit (16 bytes key) or 256-bit (32 bytes key)
+// AES block cipher wrapped in Galois Counter Mode with the standard nonce
+// length. For best security, every stream should have a unique key.
+func NewAESGCMCipher(key []byte) (*CryptoAEADCipher, error) {
+	return newCryptoAEADCipherWithKey(key, newAESGCM, aesGCMUsageLimits)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewCryptoAEADCipher(cipher), nil
+	return cipher.NewGCM(block)
+}
+
+// NewChaCha20Poly1305Cipher creates a ChaCha20-Poly1305 AEAD that uses the
+// given 256-bit key.
+func NewChaCha20Poly1305Cipher(key []byte) (*CryptoAEADCipher, error) {
+	return newCryptoAEADCipherWithKey(key, chacha20poly1305.New, chaCha20Poly1305UsageLimits)
 }
 
 // NewXChaCha20Poly1305Cipher creates a XChaCha20-Poly1305 AEAD that uses the
 // given 256-bit key.
 func NewXChaCha20Poly1305Cipher(key []byte) (*CryptoAEADCipher, error) {
-	cipher, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		return nil, err
+	return newCryptoAEADCipherWithKey(key, chacha20poly1305.NewX, extendedNonceUsageLimits)
+}
+
+// directionalCipher uses one Cipher to encrypt outgoing data and another one
+// to decrypt incoming data. It is used by handshakes that derive separate keys
+// for each direction. Both ciphers should have the same nonce size.
+type directionalCipher struct {
+	encrypt Cipher
+	decrypt Cipher
+}
+
+// newDirectionalCipher creates a directionalCipher from a pair of ciphers.
+func newDirectionalCipher(encrypt, decrypt Cipher) (*directionalCipher, error) {
+	if encrypt.NonceSize() != decrypt.NonceSize() {
+		return nil, errors.New("encrypt and decrypt cipher should have the same nonce size")
 	}
+	return &directionalCipher{
+		encrypt: encrypt,
+		decrypt: decrypt,
+	}, nil
+}
+
+// Encrypt implements Cipher.
+func (c *directionalCipher) Encrypt(ciphertext, plaintext, nonce []byte) ([]byte, error) {
+	return c.encrypt.Encrypt(ciphertext, plaintext, nonce)
+}
+
+// Decrypt implements Cipher.
+func (c *directionalCipher) Decrypt(plaintext, ciphertext, nonce []byte) ([]byte, error) {
+	return c.decrypt.Decrypt(plaintext, ciphertext, nonce)
+}
+
+// MaxOverhead implements Cipher.
+func (c *directionalCipher) MaxOverhead() int {
+	if c.encrypt.MaxOverhead() > c.decrypt.MaxOverhead() {
+		return c.encrypt.MaxOverhead()
+	}
+	return c.decrypt.MaxOverhead()
+}
+
+// NonceSize implements Cipher.
+func (c *directionalCipher) NonceSize() int {
+	return c.encrypt.NonceSize()
+}
 
-	return NewCryptoAEADCipher(cipher), nil
+// Destroy implements Destroyer.
+func (c *directionalCipher) Destroy() {
+	destroyCipher(c.encrypt)
+	destroyCipher(c.decrypt)
 }
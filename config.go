@@ -2,8 +2,11 @@ package stream
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/imdario/mergo"
+	"golang.org/x/crypto/chacha20"
 )
 
 // Config is the configuration for encrypted stream.
@@ -28,13 +31,138 @@ type Config struct {
 	// data is transmitted in the same stream. Both sides of the stream should set
 	// this to the same value unless DisableNonceVerification is true. IMPORTANT:
 	// Enable sequential nonce only when key is unique for every stream, otherwise
-	// key will be leaked.
+	// key will be leaked. Use NewMasterKeyStream to derive unique keys from a
+	// key shared by many streams.
 	SequentialNonce bool
 
 	// Disable nonce verification during decryption. Setting this to true will
 	// make the stream vulnerable to reflection, replay, re-order and packet drop
 	// attack. Do not set it to true unless you have a strong reason.
 	DisableNonceVerification bool
+
+	// Preamble enables protocol preamble, which makes an encrypted stream
+	// distinguishable from other data and allows the wire format to evolve.
+	// When the stream is created, initiator sends magic bytes and the range of
+	// protocol versions it supports, and responder replies with magic bytes and
+	// the highest version supported by both sides, which is available through
+	// ProtocolVersion of the stream. Both sides also send their stream
+	// parameters (e.g. MaxChunkSize and SequentialNonce), so mismatched config
+	// fails with *ParameterMismatchError. Both sides then confirm the preamble
+	// with an encrypted chunk, so a preamble modified in transit (e.g. to
+	// downgrade the version) fails with ErrPreambleMismatch. Unless
+	// RequirePreamble is true, responder with preamble enabled also accepts
+	// initiator that does not send preamble (legacy format), so preamble can be
+	// enabled on responders first, then on initiators. Note that responder
+	// with preamble enabled waits for the first bytes from initiator when the
+	// stream is created. Since preamble confirmation is encrypted with the
+	// first nonce, preamble can not be used together with MarshalState.
+	Preamble bool
+
+	// RequirePreamble makes responder with Preamble enabled reject initiator
+	// that does not send preamble with ErrInvalidPreamble.
+	RequirePreamble bool
+
+	// KeyUpdate enables in-band key update, so that a long-lived stream does not
+	// need to be recreated when the sequential nonce is exhausted. Each chunk
+	// then starts with a frame type byte, and a key update control frame is sent
+	// before switching the encryption key to a new key derived from the current
+	// one, when any of the KeyUpdateAfterChunks, KeyUpdateAfterBytes and
+	// KeyUpdateInterval limits is reached, or before ErrMaxNonce would be
+	// returned. The peer switches its decryption key when receiving the frame,
+	// and switches its own encryption key before its next Write, so both
+	// directions get new keys. Key update is transparent to Read and Write. Both
+	// sides of the stream should set this to the same value, and Cipher should
+	// implement KeyUpdater.
+	KeyUpdate bool
+
+	// KeyUpdateAfterChunks is the max number of chunks encrypted with the same
+	// key when KeyUpdate is true. Zero means no limit.
+	KeyUpdateAfterChunks uint64
+
+	// KeyUpdateAfterBytes is the max number of plaintext bytes encrypted with
+	// the same key when KeyUpdate is true. Zero means no limit.
+	KeyUpdateAfterBytes uint64
+
+	// KeyUpdateInterval is the max duration that the same key is used to
+	// encrypt when KeyUpdate is true. It is checked when writing. Zero means no
+	// limit.
+	KeyUpdateInterval time.Duration
+
+	// RatchetInterval enables forward-secret key ratchet when greater than
+	// zero. Encoder and decoder advance their key with a one-way function after
+	// every RatchetInterval chunks, and erase the previous key, so that
+	// compromising the current state of a long-lived stream does not reveal
+	// earlier chunks. Both sides of the stream should set this to the same
+	// value, and Cipher should implement KeyUpdater. Note that the key of
+	// Config.Cipher is only erased if the stream is created by a handshake,
+	// otherwise the caller should discard it after creating the stream.
+	RatchetInterval uint64
+
+	// DHRekeyInterval enables periodic DH rekey for post-compromise security
+	// when greater than zero, and requires KeyUpdate to be true. Every
+	// DHRekeyInterval (checked when writing), a fresh ephemeral X25519 public
+	// key is sent inside the encrypted channel, the peer replies with its own
+	// one, and the shared secret is mixed into the next keys of both
+	// directions, so that an attacker who has stolen the keys of the stream can
+	// no longer decrypt it after the next DH rekey unless it actively
+	// intercepts the rekey. The peer replies and switches key in its next
+	// Write. A peer with KeyUpdate enabled always replies to DH rekey,
+	// regardless of its own DHRekeyInterval.
+	DHRekeyInterval time.Duration
+
+	// UsageLimitAction is the action to take when the usage limits of the
+	// encryption key (see UsageLimiter) are reached, e.g. 2^32 chunks for
+	// AES-GCM and ChaCha20-Poly1305 with random nonce. By default Write returns
+	// *UsageLimitError. UsageLimitActionKeyUpdate updates the key before the
+	// limits are reached, which requires KeyUpdate to be true. Reaching the max
+	// number of failed decryptions always makes Read return *UsageLimitError.
+	UsageLimitAction UsageLimitAction
+
+	// KeyIDs enables key ID in the header of each chunk for seamless key
+	// rotation, e.g. of a pre-shared key used by a fleet. The ID of
+	// Config.Cipher is KeyID. A new key can be added on receiving side by
+	// AddDecryptionKey while the previous keys are still in use, then the
+	// sending side can switch to it at any time by SetEncryptionKey without
+	// losing data, and old keys can be dropped by RetireDecryptionKey or
+	// RetireDecryptionKeysNotSeenSince. Both sides of the stream should set this
+	// to the same value. It can not be used together with KeyUpdate or
+	// RatchetInterval.
+	KeyIDs bool
+
+	// KeyID is the key ID of Config.Cipher when KeyIDs is true.
+	KeyID uint32
+
+	// DestroyCipher makes Close destroy Config.Cipher and the ciphers passed to
+	// SetEncryptionKey and AddDecryptionKey (see Destroyer), so that their key
+	// material does not remain in memory after the stream is closed. It should
+	// only be set if these ciphers are not shared with other streams. Ciphers
+	// created by handshakes and key updates are always destroyed by Close.
+	DestroyCipher bool
+
+	// AuthenticateHeader makes the length prefix and header (e.g. key ID) of
+	// each chunk authenticated as additional data of the AEAD, so that framing
+	// metadata is bound to the chunk and can not be modified without failing
+	// decryption. Cipher should implement AdditionalDataCipher, as
+	// CryptoAEADCipher does. Both sides of the stream should set this to the
+	// same value.
+	AuthenticateHeader bool
+
+	// EncryptLength makes the length prefix of each chunk encrypted with
+	// LengthKey, similar to OpenSSH chacha20-poly1305, so that an on-path
+	// observer can not read chunk sizes from it. The encrypted length is
+	// authenticated as in AuthenticateHeader, which it implies. Read still
+	// rejects an oversize length before reading the chunk body. Both sides of
+	// the stream should set this to the same value. It can not be used together
+	// with MarshalState.
+	EncryptLength bool
+
+	// LengthKey is the 32 bytes key used to encrypt the length prefix when
+	// EncryptLength is true. It should be different from the key of Cipher, and
+	// must not be reused by another stream, as the keystream only depends on
+	// the key and direction. If the stream is created by a handshake, the key
+	// is derived from session keys (with LengthKey as salt if it is set), so it
+	// is always unique. The stream keeps its own copy, which is erased by Close.
+	LengthKey []byte
 }
 
 // DefaultConfig returns the default config.
@@ -62,9 +190,60 @@ func (config *Config) Verify() error {
 		return errors.New("MaxChunkSize should be greater than 0")
 	}
 
+	if config.Preamble && config.maxEncryptedChunkSize() > maxLegacyChunkSize() {
+		return errors.New("MaxChunkSize is too large to use preamble")
+	}
+
+	if config.KeyUpdate && config.MaxChunkSize < maxControlFrameSize {
+		return errors.New("MaxChunkSize is too small to use key update")
+	}
+
+	if config.DHRekeyInterval > 0 && !config.KeyUpdate {
+		return errors.New("DHRekeyInterval requires KeyUpdate")
+	}
+
+	if config.KeyIDs && (config.KeyUpdate || config.RatchetInterval > 0) {
+		return errors.New("KeyIDs can not be used together with KeyUpdate or RatchetInterval")
+	}
+
+	if config.UsageLimitAction == UsageLimitActionKeyUpdate && !config.KeyUpdate {
+		return errors.New("UsageLimitActionKeyUpdate requires KeyUpdate")
+	}
+
+	if (config.KeyUpdate || config.RatchetInterval > 0) && !supportsKeyUpdate(config.Cipher) {
+		return ErrKeyUpdateNotSupported
+	}
+
+	if (config.AuthenticateHeader || config.EncryptLength) && !supportsAdditionalData(config.Cipher) {
+		return ErrAdditionalDataNotSupported
+	}
+
+	if config.EncryptLength && len(config.LengthKey) != chacha20.KeySize {
+		return fmt.Errorf("LengthKey should be %d bytes when EncryptLength is true", chacha20.KeySize)
+	}
+
 	return nil
 }
 
+// frameHeaderSize returns the number of bytes added to each plaintext chunk
+// before encryption.
+func (config *Config) frameHeaderSize() int {
+	if config.KeyUpdate {
+		return frameTypeSize
+	}
+	return 0
+}
+
+// maxEncryptedChunkSize returns the max size of an encrypted chunk including
+// nonce and key ID.
+func (config *Config) maxEncryptedChunkSize() int {
+	n := config.MaxChunkSize + config.frameHeaderSize() + config.Cipher.MaxOverhead() + config.Cipher.NonceSize()
+	if config.KeyIDs {
+		n += keyIDSize
+	}
+	return n
+}
+
 // MergeConfig merges a given config with the default config recursively. Any
 // non zero value fields will override the default config.
 func MergeConfig(base, conf *Config) (*Config, error) {
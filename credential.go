@@ -0,0 +1,262 @@
+package stream
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// credentialSignatureContext is prepended to the data signed by credential
+	// issuer.
+	credentialSignatureContext = "encrypted-stream credential"
+
+	// maxCredentialChainLength is the max number of credentials in a chain.
+	maxCredentialChainLength = 4
+)
+
+// Credential is a compact certificate in which an issuer Ed25519 key signs a
+// subject Ed25519 key, an expiry time and a set of attributes. A credential
+// chain is a list of credentials starting from the one whose subject is the
+// key used in handshake, where each credential is issued by the subject of the
+// next one, and the last one is issued by a trust root. Every credential except
+// the first one should be a CA credential, and can only issue attributes that
+// it holds itself.
+type Credential struct {
+	// Issuer is the public key of the issuer.
+	Issuer ed25519.PublicKey
+
+	// Subject is the public key certified by the credential.
+	Subject ed25519.PublicKey
+
+	// NotAfter is the expiry time of the credential, with second precision.
+	NotAfter time.Time
+
+	// Attributes are application defined attributes of the subject.
+	Attributes map[string]string
+
+	// IsCA indicates whether subject can issue credentials in a chain.
+	IsCA bool
+
+	// Signature is the issuer's signature of the other fields.
+	Signature []byte
+}
+
+// IssueCredential creates a credential that certifies subject with the given
+// expiry time and attributes, signed by issuer's private key. Subject can not
+// issue credentials with it, see IssueCACredential.
+func IssueCredential(issuer ed25519.PrivateKey, subject ed25519.PublicKey, notAfter time.Time, attributes map[string]string) (*Credential, error) {
+	return newCredential(issuer, subject, notAfter, attributes, false)
+}
+
+// IssueCACredential is the same as IssueCredential, but subject can issue
+// credentials with a subset of the given attributes, e.g. as an intermediate
+// issuer in a credential chain.
+func IssueCACredential(issuer ed25519.PrivateKey, subject ed25519.PublicKey, notAfter time.Time, attributes map[string]string) (*Credential, error) {
+	return newCredential(issuer, subject, notAfter, attributes, true)
+}
+
+func newCredential(issuer ed25519.PrivateKey, subject ed25519.PublicKey, notAfter time.Time, attributes map[string]string, isCA bool) (*Credential, error) {
+	if len(issuer) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("issuer private key should be %d bytes", ed25519.PrivateKeySize)
+	}
+
+	if len(subject) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("subject public key should be %d bytes", ed25519.PublicKeySize)
+	}
+
+	c := &Credential{
+		Issuer:     issuer.Public().(ed25519.PublicKey),
+		Subject:    subject,
+		NotAfter:   time.Unix(notAfter.Unix(), 0),
+		Attributes: attributes,
+		IsCA:       isCA,
+	}
+
+	signedData, err := c.signedData()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Signature = ed25519.Sign(issuer, signedData)
+
+	return c, nil
+}
+
+// signedData returns the data signed by issuer.
+func (c *Credential) signedData() ([]byte, error) {
+	attributes, err := c.marshalAttributes()
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalFields([]byte(credentialSignatureContext), c.Issuer, c.Subject, c.marshalNotAfter(), attributes, c.marshalFlags())
+}
+
+func (c *Credential) marshalFlags() []byte {
+	if c.IsCA {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (c *Credential) marshalNotAfter() []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(c.NotAfter.Unix()))
+	return b
+}
+
+// marshalAttributes encodes attributes as key value pairs sorted by key.
+func (c *Credential) marshalAttributes() ([]byte, error) {
+	keys := make([]string, 0, len(c.Attributes))
+	for k := range c.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([][]byte, 0, 2*len(keys))
+	for _, k := range keys {
+		fields = append(fields, []byte(k), []byte(c.Attributes[k]))
+	}
+
+	return marshalFields(fields...)
+}
+
+// Marshal encodes the credential into bytes. Returns error if a field or
+// attribute is longer than 65535 bytes.
+func (c *Credential) Marshal() ([]byte, error) {
+	attributes, err := c.marshalAttributes()
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalFields(c.Issuer, c.Subject, c.marshalNotAfter(), attributes, c.marshalFlags(), c.Signature)
+}
+
+// UnmarshalCredential decodes a credential encoded by Marshal. It does not
+// verify the signature.
+func UnmarshalCredential(b []byte) (*Credential, error) {
+	fields, err := unmarshalFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) != 6 || len(fields[0]) != ed25519.PublicKeySize || len(fields[1]) != ed25519.PublicKeySize || len(fields[2]) != 8 || len(fields[4]) != 1 || fields[4][0] > 1 || len(fields[5]) != ed25519.SignatureSize {
+		return nil, errors.New("invalid credential")
+	}
+
+	attributes, err := unmarshalFields(fields[3])
+	if err != nil || len(attributes)%2 != 0 {
+		return nil, errors.New("invalid credential attributes")
+	}
+
+	c := &Credential{
+		Issuer:     ed25519.PublicKey(fields[0]),
+		Subject:    ed25519.PublicKey(fields[1]),
+		NotAfter:   time.Unix(int64(binary.LittleEndian.Uint64(fields[2])), 0),
+		Attributes: make(map[string]string, len(attributes)/2),
+		IsCA:       fields[4][0] == 1,
+		Signature:  fields[5],
+	}
+
+	for i := 0; i < len(attributes); i += 2 {
+		c.Attributes[string(attributes[i])] = string(attributes[i+1])
+	}
+
+	return c, nil
+}
+
+// VerifyCredentialChain verifies that chain certifies subject and is issued by
+// one of the trust roots, and that no credential in chain has expired at the
+// given time. Each issuer in chain other than trust root should be certified
+// by a CA credential holding all attributes it issues. Returns the attributes
+// of the first credential in chain.
+func VerifyCredentialChain(chain []*Credential, subject ed25519.PublicKey, trustRoots []ed25519.PublicKey, now time.Time) (map[string]string, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no credential")
+	}
+
+	if len(chain) > maxCredentialChainLength {
+		return nil, fmt.Errorf("credential chain is longer than %d", maxCredentialChainLength)
+	}
+
+	for i, c := range chain {
+		if !c.Subject.Equal(subject) {
+			return nil, fmt.Errorf("credential %d has unexpected subject", i)
+		}
+
+		if now.After(c.NotAfter) {
+			return nil, fmt.Errorf("credential %d expired at %v", i, c.NotAfter)
+		}
+
+		signedData, err := c.signedData()
+		if err != nil {
+			return nil, err
+		}
+
+		if !ed25519.Verify(c.Issuer, signedData, c.Signature) {
+			return nil, fmt.Errorf("credential %d has invalid signature", i)
+		}
+
+		if i > 0 && !c.IsCA {
+			return nil, fmt.Errorf("credential %d is not a CA credential but issues credential %d", i, i-1)
+		}
+
+		if i+1 < len(chain) {
+			for k, v := range c.Attributes {
+				if issuerValue, ok := chain[i+1].Attributes[k]; !ok || issuerValue != v {
+					return nil, fmt.Errorf("credential %d has attribute %q not held by its issuer", i, k)
+				}
+			}
+		}
+
+		subject = c.Issuer
+	}
+
+	for _, root := range trustRoots {
+		if root.Equal(subject) {
+			return chain[0].Attributes, nil
+		}
+	}
+
+	return nil, fmt.Errorf("credential issuer %s is not trusted", fingerprint(subject))
+}
+
+// marshalCredentialChain encodes a credential chain into bytes.
+func marshalCredentialChain(chain []*Credential) ([]byte, error) {
+	fields := make([][]byte, 0, len(chain))
+	for _, c := range chain {
+		b, err := c.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, b)
+	}
+	return marshalFields(fields...)
+}
+
+// unmarshalCredentialChain decodes bytes encoded by marshalCredentialChain.
+func unmarshalCredentialChain(b []byte) ([]*Credential, error) {
+	fields, err := unmarshalFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) > maxCredentialChainLength {
+		return nil, fmt.Errorf("credential chain is longer than %d", maxCredentialChainLength)
+	}
+
+	chain := make([]*Credential, 0, len(fields))
+	for _, field := range fields {
+		c, err := UnmarshalCredential(field)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, c)
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,220 @@
+package stream
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func generateEd25519Key(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey, privateKey
+}
+
+func issueCredential(t *testing.T, issuer ed25519.PrivateKey, subject ed25519.PublicKey, notAfter time.Time, attributes map[string]string) *Credential {
+	c, err := IssueCredential(issuer, subject, notAfter, attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func issueCACredential(t *testing.T, issuer ed25519.PrivateKey, subject ed25519.PublicKey, notAfter time.Time, attributes map[string]string) *Credential {
+	c, err := IssueCACredential(issuer, subject, notAfter, attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCredentialMarshal(t *testing.T) {
+	_, issuerKey := generateEd25519Key(t)
+	subject, _ := generateEd25519Key(t)
+
+	for _, c := range []*Credential{
+		issueCredential(t, issuerKey, subject, time.Now().Add(time.Hour), map[string]string{"role": "admin", "region": "us"}),
+		issueCACredential(t, issuerKey, subject, time.Now().Add(time.Hour), map[string]string{"role": "admin"}),
+	} {
+		b, err := c.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := UnmarshalCredential(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(c, decoded) {
+			t.Fatal("decoded credential is different from original one")
+		}
+	}
+}
+
+func TestVerifyCredentialChain(t *testing.T) {
+	rootPub, rootKey := generateEd25519Key(t)
+	intermediatePub, intermediateKey := generateEd25519Key(t)
+	subject, _ := generateEd25519Key(t)
+	otherRoot, _ := generateEd25519Key(t)
+
+	now := time.Now()
+	attributes := map[string]string{"role": "device"}
+	leaf := issueCredential(t, intermediateKey, subject, now.Add(time.Hour), attributes)
+	intermediate := issueCACredential(t, rootKey, intermediatePub, now.Add(24*time.Hour), map[string]string{"role": "device", "region": "us"})
+	chain := []*Credential{leaf, intermediate}
+
+	verified, err := VerifyCredentialChain(chain, subject, []ed25519.PublicKey{otherRoot, rootPub}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(verified, attributes) {
+		t.Fatalf("expect attributes %v, got %v", attributes, verified)
+	}
+
+	_, err = VerifyCredentialChain(chain, subject, []ed25519.PublicKey{otherRoot}, now)
+	if err == nil {
+		t.Fatal("chain issued by untrusted root should be rejected")
+	}
+
+	_, err = VerifyCredentialChain(chain, subject, []ed25519.PublicKey{rootPub}, now.Add(2*time.Hour))
+	if err == nil {
+		t.Fatal("expired chain should be rejected")
+	}
+
+	_, err = VerifyCredentialChain(chain, intermediatePub, []ed25519.PublicKey{rootPub}, now)
+	if err == nil {
+		t.Fatal("chain of another subject should be rejected")
+	}
+
+	leaf.Attributes = map[string]string{"role": "admin"}
+	_, err = VerifyCredentialChain(chain, subject, []ed25519.PublicKey{rootPub}, now)
+	if err == nil {
+		t.Fatal("tampered credential should be rejected")
+	}
+}
+
+func TestVerifyCredentialChainLeafIssuer(t *testing.T) {
+	rootPub, rootKey := generateEd25519Key(t)
+	leafPub, leafKey := generateEd25519Key(t)
+	subject, _ := generateEd25519Key(t)
+
+	now := time.Now()
+	attributes := map[string]string{"role": "admin"}
+	leaf := issueCredential(t, rootKey, leafPub, now.Add(time.Hour), attributes)
+	chain := []*Credential{issueCredential(t, leafKey, subject, now.Add(time.Hour), attributes), leaf}
+
+	_, err := VerifyCredentialChain(chain, subject, []ed25519.PublicKey{rootPub}, now)
+	if err == nil {
+		t.Fatal("credential issued by a leaf should be rejected")
+	}
+}
+
+func TestVerifyCredentialChainAttributeEscalation(t *testing.T) {
+	rootPub, rootKey := generateEd25519Key(t)
+	intermediatePub, intermediateKey := generateEd25519Key(t)
+	subject, _ := generateEd25519Key(t)
+
+	now := time.Now()
+	intermediate := issueCACredential(t, rootKey, intermediatePub, now.Add(time.Hour), map[string]string{"role": "device"})
+
+	for _, attributes := range []map[string]string{{"role": "admin"}, {"role": "device", "region": "us"}} {
+		chain := []*Credential{issueCredential(t, intermediateKey, subject, now.Add(time.Hour), attributes), intermediate}
+		_, err := VerifyCredentialChain(chain, subject, []ed25519.PublicKey{rootPub}, now)
+		if err == nil {
+			t.Fatalf("attributes %v not held by issuer should be rejected", attributes)
+		}
+	}
+}
+
+func TestHandshakeCredentials(t *testing.T) {
+	rootPub, rootKey := generateEd25519Key(t)
+	alicePub, aliceKey := generateEd25519Key(t)
+	bobPub, bobKey := generateEd25519Key(t)
+
+	notAfter := time.Now().Add(time.Hour)
+	aliceCredential := issueCredential(t, rootKey, alicePub, notAfter, map[string]string{"name": "alice"})
+	bobCredential := issueCredential(t, rootKey, bobPub, notAfter, map[string]string{"name": "bob"})
+
+	ticketKeys, err := NewSessionTicketKeys(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceConfig := HandshakeConfig{
+		PrivateKey:  aliceKey,
+		Credentials: []*Credential{aliceCredential},
+		TrustRoots:  []ed25519.PublicKey{rootPub},
+	}
+	bobConfig := HandshakeConfig{
+		PrivateKey:        bobKey,
+		Credentials:       []*Credential{bobCredential},
+		TrustRoots:        []ed25519.PublicKey{rootPub},
+		SessionTicketKeys: ticketKeys,
+	}
+
+	aliceEncrypted, bobEncrypted := ticketHandshake(t, aliceConfig, bobConfig)
+	if aliceEncrypted.PeerAttributes()["name"] != "bob" || bobEncrypted.PeerAttributes()["name"] != "alice" {
+		t.Fatal("wrong peer attributes")
+	}
+
+	// Attributes are restored in resumed session.
+	aliceConfig.SessionTicket = aliceEncrypted.SessionTicket()
+	aliceEncrypted, bobEncrypted = ticketHandshake(t, aliceConfig, bobConfig)
+	if !aliceEncrypted.Resumed() {
+		t.Fatal("handshake with session ticket should be resumed")
+	}
+	if aliceEncrypted.PeerAttributes()["name"] != "bob" || bobEncrypted.PeerAttributes()["name"] != "alice" {
+		t.Fatal("wrong peer attributes in resumed session")
+	}
+}
+
+func TestHandshakeCredentialsUntrusted(t *testing.T) {
+	rootPub, _ := generateEd25519Key(t)
+	_, otherRootKey := generateEd25519Key(t)
+	alicePub, aliceKey := generateEd25519Key(t)
+	_, bobKey := generateEd25519Key(t)
+
+	aliceCredential := issueCredential(t, otherRootKey, alicePub, time.Now().Add(time.Hour), nil)
+
+	for _, credentials := range [][]*Credential{nil, {aliceCredential}} {
+		alice, bob := net.Pipe()
+		_, _, err := handshakePair(
+			alice,
+			bob,
+			handshake(HandshakeConfig{Initiator: true, PrivateKey: aliceKey, Credentials: credentials}),
+			handshake(HandshakeConfig{PrivateKey: bobKey, TrustRoots: []ed25519.PublicKey{rootPub}}),
+		)
+		if err == nil {
+			t.Fatal("handshake with untrusted credential should fail")
+		}
+	}
+}
+
+func TestCredentialAttributeTooLarge(t *testing.T) {
+	_, issuerKey := generateEd25519Key(t)
+	subject, _ := generateEd25519Key(t)
+
+	_, err := IssueCredential(issuerKey, subject, time.Now().Add(time.Hour), map[string]string{"role": string(make([]byte, 65536))})
+	if err == nil {
+		t.Fatal("attribute larger than 65535 bytes should be rejected")
+	}
+}
+
+func TestHandshakeTrustRootsWithoutPrivateKey(t *testing.T) {
+	rootPub, _ := generateEd25519Key(t)
+	alice, _ := net.Pipe()
+
+	// Peer would not be authenticated, so no credential chain would be
+	// required.
+	_, err := Handshake(alice, &HandshakeConfig{Initiator: true, TrustRoots: []ed25519.PublicKey{rootPub}})
+	if err == nil {
+		t.Fatal("TrustRoots without PrivateKey should be rejected")
+	}
+}
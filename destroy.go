@@ -0,0 +1,205 @@
+package stream
+
+import "io"
+
+// destroy destroys the cipher of Encoder if it is owned by Encoder (see
+// SetRatchetInterval), and erases the nonce state. Returns the cipher if it is
+// not owned by Encoder, which may still be used by others. Encoder should not
+// be used afterwards.
+func (e *Encoder) destroy() ([]Cipher, error) {
+	var shared []Cipher
+	var err error
+	if e.cipher != nil {
+		if e.ownsCipher {
+			err = destroyCipher(e.cipher)
+		} else {
+			shared = append(shared, e.cipher)
+		}
+	}
+
+	erase(e.nextNonce)
+
+	return shared, err
+}
+
+// destroy destroys the cipher of Decoder if it is owned by Decoder, removes the
+// keys in the keyring, and erases the nonce state. Returns the ciphers not
+// owned by Decoder, which may still be used by others. Decoder should not be
+// used afterwards.
+func (d *Decoder) destroy() ([]Cipher, error) {
+	var shared []Cipher
+	var err error
+	if d.cipher != nil {
+		if d.ownsCipher {
+			err = destroyCipher(d.cipher)
+		} else {
+			shared = append(shared, d.cipher)
+		}
+	}
+
+	d.keyringLock.Lock()
+	for keyID, key := range d.keyring {
+		shared = append(shared, key.cipher)
+		delete(d.keyring, keyID)
+	}
+	d.keyringLock.Unlock()
+
+	erase(d.nextNonce)
+
+	return shared, err
+}
+
+// lockRead acquires read lock. Returns io.ErrClosedPipe without holding the
+// lock if the stream is closed.
+func (es *EncryptedStream) lockRead() error {
+	if es.IsClosed() {
+		return io.ErrClosedPipe
+	}
+
+	es.readLock.Lock()
+
+	if es.IsClosed() {
+		es.unlockRead()
+		return io.ErrClosedPipe
+	}
+
+	return nil
+}
+
+// unlockRead releases read lock. If the stream is closed while holding the
+// lock, read side is destroyed here since Close can not do it.
+func (es *EncryptedStream) unlockRead() {
+	es.readLock.Unlock()
+
+	if es.IsClosed() {
+		es.tryDestroyRead()
+	}
+}
+
+// lockWrite acquires write lock. Returns io.ErrClosedPipe without holding the
+// lock if the stream is closed.
+func (es *EncryptedStream) lockWrite() error {
+	if es.IsClosed() {
+		return io.ErrClosedPipe
+	}
+
+	es.writeLock.Lock()
+
+	if es.IsClosed() {
+		es.unlockWrite()
+		return io.ErrClosedPipe
+	}
+
+	return nil
+}
+
+// unlockWrite releases write lock. If the stream is closed while holding the
+// lock, write side is destroyed here since Close can not do it.
+func (es *EncryptedStream) unlockWrite() {
+	es.writeLock.Unlock()
+
+	if es.IsClosed() {
+		es.tryDestroyWrite()
+	}
+}
+
+// tryDestroyRead destroys read side of a closed stream if read lock is not
+// held, otherwise it is left to the holder of read lock, so that Close does
+// not block on a pending Read.
+func (es *EncryptedStream) tryDestroyRead() error {
+	if !es.readLock.TryLock() {
+		return nil
+	}
+	defer es.readLock.Unlock()
+
+	if es.readDestroyed {
+		return nil
+	}
+	es.readDestroyed = true
+
+	erase(es.decryptBuffer[:cap(es.decryptBuffer)])
+	es.decryptBufStart, es.decryptBufEnd = 0, 0
+	erase(es.earlyData)
+	es.earlyData = nil
+	if es.readLengthCipher != nil {
+		es.readLengthCipher.destroy()
+		es.readLengthCipher = nil
+	}
+
+	shared, err := es.decoder.destroy()
+	if e := es.destroySharedCiphers(shared); e != nil && err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// tryDestroyWrite destroys write side of a closed stream if write lock is not
+// held. See tryDestroyRead.
+func (es *EncryptedStream) tryDestroyWrite() error {
+	if !es.writeLock.TryLock() {
+		return nil
+	}
+	defer es.writeLock.Unlock()
+
+	if es.writeDestroyed {
+		return nil
+	}
+	es.writeDestroyed = true
+
+	erase(es.frameBuffer[:cap(es.frameBuffer)])
+	if es.writeLengthCipher != nil {
+		es.writeLengthCipher.destroy()
+		es.writeLengthCipher = nil
+	}
+
+	shared, err := es.encoder.destroy()
+	if e := es.destroySharedCiphers(shared); e != nil && err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// destroySharedCiphers collects the ciphers not owned by Encoder or Decoder
+// after one side is destroyed. Since Config.Cipher may be used by both sides,
+// they are only destroyed (if Config.DestroyCipher is true) by whichever side
+// is destroyed last, when neither side can use them anymore.
+func (es *EncryptedStream) destroySharedCiphers(shared []Cipher) error {
+	es.destroyLock.Lock()
+	defer es.destroyLock.Unlock()
+
+	es.sharedCiphers = append(es.sharedCiphers, shared...)
+	es.destroyedSides++
+	if es.destroyedSides < 2 {
+		return nil
+	}
+
+	var err error
+	if es.config.DestroyCipher {
+		for _, cipher := range es.sharedCiphers {
+			if e := destroyCipher(cipher); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	es.sharedCiphers = nil
+
+	return err
+}
+
+// destroyRekeyState erases the secrets of DH rekeys in progress.
+func (es *EncryptedStream) destroyRekeyState() {
+	es.rekeyLock.Lock()
+	defer es.rekeyLock.Unlock()
+
+	for _, b := range [][]byte{es.rekey.privateKey, es.rekey.sendSecret, es.rekey.responseSecret, es.rekey.receiveSecret} {
+		erase(b)
+	}
+
+	es.rekey.privateKey = nil
+	es.rekey.sendSecret = nil
+	es.rekey.responsePublicKey = nil
+	es.rekey.responseSecret = nil
+	es.rekey.receiveSecret = nil
+}
@@ -0,0 +1,248 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCipherDestroy(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+
+	aesgcm, err := NewAESGCMCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chacha, err := NewChaCha20Poly1305Cipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xchacha, err := NewXChaCha20Poly1305Cipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xsalsa := NewXSalsa20Poly1305Cipher(&key)
+
+	for _, cipher := range []Cipher{aesgcm, chacha, xchacha, xsalsa} {
+		nonce := make([]byte, cipher.NonceSize())
+		ciphertext, err := cipher.Encrypt(make([]byte, 128), []byte("hello"), nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cipher.(Destroyer).Destroy()
+		cipher.(Destroyer).Destroy()
+
+		if cipher.NonceSize() != len(nonce) || cipher.MaxOverhead() == 0 {
+			t.Fatal("nonce size and overhead should not change after Destroy")
+		}
+
+		_, err = cipher.Encrypt(make([]byte, 128), []byte("hello"), nonce)
+		if err != ErrCipherDestroyed {
+			t.Fatalf("expect ErrCipherDestroyed, got %v", err)
+		}
+
+		_, err = cipher.Decrypt(make([]byte, 128), ciphertext, nonce)
+		if err != ErrCipherDestroyed {
+			t.Fatalf("expect ErrCipherDestroyed, got %v", err)
+		}
+
+		_, err = cipher.(KeyUpdater).UpdateKey(nil)
+		if err != ErrCipherDestroyed {
+			t.Fatalf("expect ErrCipherDestroyed, got %v", err)
+		}
+	}
+
+	if key != [32]byte{} {
+		t.Fatal("key of XSalsa20Poly1305Cipher should be erased")
+	}
+}
+
+func TestCloseDestroy(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, handshake(HandshakeConfig{Initiator: true}), handshake(HandshakeConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("secret"), 100)
+	go write(aliceEncrypted, data)
+
+	// Leave decrypted data in buffer.
+	_, err = bobEncrypted.Read(make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptCipher := bobEncrypted.encoder.cipher
+	decryptCipher := bobEncrypted.decoder.cipher
+	decryptBuffer := bobEncrypted.decryptBuffer[:cap(bobEncrypted.decryptBuffer)]
+
+	err = bobEncrypted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decryptBuffer, make([]byte, len(decryptBuffer))) {
+		t.Fatal("decrypted data should be erased")
+	}
+
+	_, err = encryptCipher.Encrypt(make([]byte, 1024), data, make([]byte, encryptCipher.NonceSize()))
+	if !errors.Is(err, ErrCipherDestroyed) {
+		t.Fatalf("encryption cipher should be destroyed, got %v", err)
+	}
+
+	_, err = decryptCipher.Decrypt(make([]byte, 1024), data, make([]byte, decryptCipher.NonceSize()))
+	if !errors.Is(err, ErrCipherDestroyed) {
+		t.Fatalf("decryption cipher should be destroyed, got %v", err)
+	}
+
+	_, err = bobEncrypted.Read(make([]byte, 10))
+	if err != io.ErrClosedPipe {
+		t.Fatalf("expect io.ErrClosedPipe, got %v", err)
+	}
+
+	_, err = bobEncrypted.ExportKeyingMaterial("test", nil, 32)
+	if err != io.ErrClosedPipe {
+		t.Fatalf("expect io.ErrClosedPipe, got %v", err)
+	}
+
+	aliceEncrypted.Close()
+}
+
+func TestCloseDuringRead(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close of underlying stream can not interrupt pending Read.
+	unclosable := struct{ io.ReadWriter }{bob}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, unclosable, handshake(HandshakeConfig{Initiator: true}), handshake(HandshakeConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aliceEncrypted.Close()
+
+	decryptCipher := bobEncrypted.decoder.cipher
+
+	readChan := make(chan error, 1)
+	go func() {
+		_, err := bobEncrypted.Read(make([]byte, 10))
+		readChan <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	err = bobEncrypted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go write(aliceEncrypted, []byte("hello"))
+	<-readChan
+
+	_, err = decryptCipher.Decrypt(make([]byte, 1024), make([]byte, 64), make([]byte, decryptCipher.NonceSize()))
+	if !errors.Is(err, ErrCipherDestroyed) {
+		t.Fatalf("decryption cipher should be destroyed after pending Read returns, got %v", err)
+	}
+}
+
+func TestConfigDestroyCipher(t *testing.T) {
+	for _, destroy := range []bool{false, true} {
+		cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		es, err := NewEncryptedStream(nil, &Config{Cipher: cipher, DestroyCipher: destroy})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = es.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = cipher.Encrypt(make([]byte, 128), []byte("hello"), make([]byte, cipher.NonceSize()))
+		if destroy && err != ErrCipherDestroyed {
+			t.Fatalf("expect ErrCipherDestroyed, got %v", err)
+		}
+		if !destroy && err != nil {
+			t.Fatalf("shared cipher should not be destroyed, got %v", err)
+		}
+	}
+}
+
+func TestCloseDuringWriteDestroyCipher(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobCipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		newStream(Config{Cipher: cipher, Initiator: true, DestroyCipher: true}),
+		newStream(Config{Cipher: bobCipher}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bobEncrypted.Close()
+
+	go func() {
+		for {
+			_, err := bobEncrypted.Read(make([]byte, 1024))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	writeChan := make(chan error, 1)
+	go func() {
+		for {
+			_, err := aliceEncrypted.Write(make([]byte, 1024))
+			if err != nil {
+				writeChan <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Shared cipher is destroyed by whichever side is destroyed last, so it
+	// does not race with pending Write (run with -race).
+	err = aliceEncrypted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-writeChan
+
+	_, err = cipher.Encrypt(make([]byte, 128), []byte("hello"), make([]byte, cipher.NonceSize()))
+	if err != ErrCipherDestroyed {
+		t.Fatalf("expect ErrCipherDestroyed, got %v", err)
+	}
+}
@@ -14,8 +14,12 @@ as reference cipher.
 3. The encrypted stream only adds a small constant memory overhead compared to
 the original stream.
 
-Note: this library does not handle handshake or key exchange. Handshake should
-be done separately before using this library to compute a shared key.
+4. An optional ephemeral X25519 handshake is provided by Handshake, which
+derives a unique key for each direction and creates an encrypted stream from
+them. NoiseHandshake performs a Noise handshake that mutually authenticates
+both sides with their long-term Curve25519 static keys. Alternatively,
+handshake can be done separately to compute a shared key before creating an
+encrypted stream with NewEncryptedStream.
 
 */
 package stream
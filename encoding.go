@@ -8,11 +8,13 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sync"
 )
 
 var (
 	// ErrMaxNonce indicates the max allowed nonce is reach. If this happends, a
-	// new stream with different key should be created.
+	// new stream with different key should be created, or key should be updated
+	// (see Config.KeyUpdate).
 	ErrMaxNonce = errors.New("max nonce reached")
 
 	// ErrWrongNonceInitiator indicates a nonce with the wrong party is received,
@@ -31,11 +33,22 @@ var (
 
 // Encoder provides encode function of a slice data.
 type Encoder struct {
-	cipher          Cipher
-	initiator       bool
-	sequentialNonce bool
-	nextNonce       []byte
-	maxNonce        []byte
+	cipher             Cipher
+	initiator          bool
+	sequentialNonce    bool
+	nextNonce          []byte
+	maxNonce           []byte
+	ownsCipher         bool
+	ratchetInterval    uint64
+	ratchetChunks      uint64
+	limits             UsageLimits
+	sealedChunks       uint64
+	sealedBytes        uint64
+	keyIDs             bool
+	keyID              uint32
+	keyUpdated         bool
+	leaseEnd           []byte
+	authenticateHeader bool
 }
 
 // NewEncoder creates a Encoder with given cipher and config.
@@ -43,51 +56,154 @@ func NewEncoder(cipher Cipher, initiator, sequentialNonce bool) (*Encoder, error
 	if cipher == nil {
 		return &Encoder{}, nil
 	}
+	// Ciphers of directionalCipher are created by handshakes for a single
+	// direction, so they can be erased after key update.
+	c, ownsCipher := cipher.(*directionalCipher)
+	if ownsCipher {
+		cipher = c.encrypt
+	}
 	encoder := &Encoder{
 		cipher:          cipher,
 		initiator:       initiator,
 		sequentialNonce: sequentialNonce,
 		nextNonce:       initNonce(cipher.NonceSize(), initiator),
 		maxNonce:        maxNonce(cipher.NonceSize(), initiator),
+		ownsCipher:      ownsCipher,
+		limits:          usageLimits(cipher, sequentialNonce),
 	}
 
 	return encoder, nil
 }
 
-// Encode encodes a plaintext to nonce + ciphertext. When sequential nonce is
-// true, Encode is not thread safe and should not be called concurrently.
+// Encode encodes a plaintext to nonce + ciphertext. Returns *UsageLimitError if
+// the usage limits of the key (see UsageLimiter) would be exceeded. When
+// sequential nonce is true, Encode is not thread safe and should not be called
+// concurrently.
 func (e *Encoder) Encode(ciphertext, plaintext []byte) ([]byte, error) {
 	if e.cipher == nil {
 		copy(ciphertext, plaintext)
 		return ciphertext[:len(plaintext)], nil
 	}
 
+	err := e.limits.checkUsage(e.sealedChunks, e.sealedBytes, 1, uint64(len(plaintext)))
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := 0
+	if e.keyIDs {
+		binary.LittleEndian.PutUint32(ciphertext[:keyIDSize], e.keyID)
+		headerSize = keyIDSize
+	}
+
 	nonceSize := e.cipher.NonceSize()
+	nonce := ciphertext[headerSize : headerSize+nonceSize]
 	if e.sequentialNonce {
 		if bytes.Compare(e.nextNonce, e.maxNonce) >= 0 {
 			return nil, ErrMaxNonce
 		}
-		copy(ciphertext[:nonceSize], e.nextNonce)
+		if e.leaseEnd != nil && bytes.Compare(e.nextNonce, e.leaseEnd) >= 0 {
+			return nil, ErrStateLeaseExpired
+		}
+		copy(nonce, e.nextNonce)
 		incrementNonce(e.nextNonce)
 	} else {
-		_, err := rand.Read(ciphertext[:nonceSize])
+		_, err := rand.Read(nonce)
 		if err != nil {
 			return nil, err
 		}
 
 		if e.initiator {
-			ciphertext[0] &= 127
+			nonce[0] &= 127
 		} else {
-			ciphertext[0] |= 128
+			nonce[0] |= 128
 		}
 	}
 
-	encrypted, err := e.cipher.Encrypt(ciphertext[nonceSize:], plaintext, ciphertext[:nonceSize])
+	encrypted, err := e.seal(ciphertext, headerSize, nonceSize, plaintext)
 	if err != nil {
 		return nil, err
 	}
 
-	return ciphertext[:nonceSize+len(encrypted)], nil
+	e.sealedChunks++
+	e.sealedBytes += uint64(len(plaintext))
+
+	if e.ratchetInterval > 0 {
+		e.ratchetChunks++
+		if e.ratchetChunks >= e.ratchetInterval {
+			err = e.ratchet(nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ciphertext[:headerSize+nonceSize+len(encrypted)], nil
+}
+
+// SetRatchetInterval makes Encoder advance its key with a one-way function
+// after every interval chunks, and erase the previous key, so that the current
+// state does not reveal the keys of earlier chunks. Zero disables it. Cipher
+// should implement KeyUpdater, and the peer's Decoder should use the same
+// interval. The key of the cipher passed to NewEncoder is only erased if it is
+// created by a handshake, as it may be shared with a Decoder.
+func (e *Encoder) SetRatchetInterval(interval uint64) {
+	e.ratchetInterval = interval
+	e.ratchetChunks = 0
+}
+
+// UpdateKey switches Encoder to a new key derived from the current key and
+// secret (can be nil), and resets the sequential nonce. Cipher should implement
+// KeyUpdater. The peer's Decoder should call UpdateKey with the same secret
+// after decoding the last chunk encoded with the current key.
+func (e *Encoder) UpdateKey(secret []byte) error {
+	err := e.ratchet(secret)
+	if err != nil {
+		return err
+	}
+
+	e.nextNonce = initNonce(e.cipher.NonceSize(), e.initiator)
+
+	return nil
+}
+
+// ratchet switches to the next key and erases the current key if it is owned
+// by Encoder.
+func (e *Encoder) ratchet(secret []byte) error {
+	cipher, err := updateKey(e.cipher, secret, e.ownsCipher)
+	if err != nil {
+		return err
+	}
+
+	e.cipher = cipher
+	e.ownsCipher = true
+	e.keyUpdated = true
+	e.ratchetChunks = 0
+	e.limits = usageLimits(cipher, e.sequentialNonce)
+	e.sealedChunks = 0
+	e.sealedBytes = 0
+
+	return nil
+}
+
+// usageLimitReached returns whether encoding a chunk of n bytes and a few
+// control frames would exceed the usage limits of the key.
+func (e *Encoder) usageLimitReached(n int) bool {
+	return e.limits.checkUsage(e.sealedChunks, e.sealedBytes, 1+usageLimitReserve, uint64(n+usageLimitReserve*(frameTypeSize+maxControlFrameSize))) != nil
+}
+
+// nonceExhausted returns whether there is at most one sequential nonce left,
+// which should be used to notify the peer of key update.
+func (e *Encoder) nonceExhausted() bool {
+	if e.cipher == nil || !e.sequentialNonce {
+		return false
+	}
+	n := len(e.nextNonce)
+	if bytes.Compare(e.nextNonce, e.maxNonce) >= 0 {
+		return true
+	}
+	// The last byte of max nonce is always 255.
+	return bytes.Equal(e.nextNonce[:n-1], e.maxNonce[:n-1]) && e.nextNonce[n-1] >= e.maxNonce[n-1]-1
 }
 
 // Decoder provides decode function of a slice data.
@@ -97,6 +213,19 @@ type Decoder struct {
 	sequentialNonce          bool
 	disableNonceVerification bool
 	nextNonce                []byte
+	ownsCipher               bool
+	ratchetInterval          uint64
+	ratchetChunks            uint64
+	limits                   UsageLimits
+	failedDecryptions        uint64
+	keyIDs                   bool
+	keyringLock              sync.Mutex
+	keyring                  map[uint32]*decoderKey
+	lastKeyID                uint32
+	keyUpdated               bool
+	resync                   bool
+	stateLock                sync.Mutex
+	authenticateHeader       bool
 }
 
 // NewDecoder creates a Decoder with given cipher and config.
@@ -104,26 +233,59 @@ func NewDecoder(cipher Cipher, initiator, sequentialNonce, disableNonceVerificat
 	if cipher == nil {
 		return &Decoder{}, nil
 	}
+	c, ownsCipher := cipher.(*directionalCipher)
+	if ownsCipher {
+		cipher = c.decrypt
+	}
 	decoder := &Decoder{
 		cipher:                   cipher,
 		initiator:                initiator,
 		sequentialNonce:          sequentialNonce,
 		disableNonceVerification: disableNonceVerification,
 		nextNonce:                initNonce(cipher.NonceSize(), !initiator),
+		ownsCipher:               ownsCipher,
+		limits:                   usageLimits(cipher, sequentialNonce),
 	}
 
 	return decoder, nil
 }
 
-// Decode decodes a nonce + ciphertext to plaintext. When sequential nonce is
-// true, Decode is not thread safe and should not be called concurrently.
+// Decode decodes a nonce + ciphertext to plaintext. Returns *UsageLimitError
+// if the max number of failed decryptions with the key (see UsageLimiter) is
+// reached. When sequential nonce is true, Decode is not thread safe and should
+// not be called concurrently.
 func (d *Decoder) Decode(plaintext, ciphertext []byte) ([]byte, error) {
 	if d.cipher == nil {
 		copy(plaintext, ciphertext)
 		return plaintext[:len(ciphertext)], nil
 	}
 
-	nonceSize := d.cipher.NonceSize()
+	chunkSize, header := len(ciphertext), ciphertext[:0]
+	cipher, limits, failedDecryptions := d.cipher, &d.limits, &d.failedDecryptions
+	var keyID uint32
+	var key *decoderKey
+	if d.keyIDs {
+		if len(ciphertext) < keyIDSize {
+			return nil, fmt.Errorf("invalid ciphertext size %d", len(ciphertext))
+		}
+
+		var err error
+		keyID = binary.LittleEndian.Uint32(ciphertext[:keyIDSize])
+		key, err = d.key(keyID)
+		if err != nil {
+			return nil, err
+		}
+
+		cipher, limits, failedDecryptions = key.cipher, &key.limits, &key.failedDecryptions
+		header = ciphertext[:keyIDSize]
+		ciphertext = ciphertext[keyIDSize:]
+	}
+
+	if limits.MaxFailedDecryptions > 0 && *failedDecryptions >= limits.MaxFailedDecryptions {
+		return nil, &UsageLimitError{Limit: "MaxFailedDecryptions", Value: limits.MaxFailedDecryptions}
+	}
+
+	nonceSize := cipher.NonceSize()
 	if len(ciphertext) <= nonceSize {
 		return nil, fmt.Errorf("invalid ciphertext size %d", len(ciphertext))
 	}
@@ -141,24 +303,113 @@ func (d *Decoder) Decode(plaintext, ciphertext []byte) ([]byte, error) {
 		}
 
 		if d.sequentialNonce {
-			if !bytes.Equal(nonce, d.nextNonce) {
+			if d.resync {
+				// The peer may skip the nonces leased before resuming.
+				if bytes.Compare(nonce, d.nextNonce) < 0 {
+					return nil, ErrWrongNonceSequential
+				}
+			} else if !bytes.Equal(nonce, d.nextNonce) {
 				return nil, ErrWrongNonceSequential
 			}
 		}
 	}
 
-	plaintext, err := d.cipher.Decrypt(plaintext, ciphertext[nonceSize:], nonce)
+	plaintext, err := d.open(cipher, plaintext, ciphertext[nonceSize:], nonce, chunkSize, header)
 	if err != nil {
+		*failedDecryptions++
 		return nil, err
 	}
 
+	if key != nil {
+		d.markKeySeen(keyID, key)
+	}
+
 	if d.sequentialNonce {
+		d.stateLock.Lock()
+		if d.resync {
+			copy(d.nextNonce, nonce)
+			d.resync = false
+		}
 		incrementNonce(d.nextNonce)
+		d.stateLock.Unlock()
+	}
+
+	if d.ratchetInterval > 0 {
+		d.ratchetChunks++
+		if d.ratchetChunks >= d.ratchetInterval {
+			err = d.ratchet(nil)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return plaintext, nil
 }
 
+// SetRatchetInterval makes Decoder advance its key after every interval
+// chunks. See Encoder.SetRatchetInterval.
+func (d *Decoder) SetRatchetInterval(interval uint64) {
+	d.ratchetInterval = interval
+	d.ratchetChunks = 0
+}
+
+// UpdateKey switches Decoder to a new key derived from the current key and
+// secret (can be nil), and resets the sequential nonce. See Encoder.UpdateKey.
+func (d *Decoder) UpdateKey(secret []byte) error {
+	err := d.ratchet(secret)
+	if err != nil {
+		return err
+	}
+
+	d.stateLock.Lock()
+	d.nextNonce = initNonce(d.cipher.NonceSize(), !d.initiator)
+	d.stateLock.Unlock()
+
+	return nil
+}
+
+// ratchet switches to the next key and erases the current key if it is owned
+// by Decoder.
+func (d *Decoder) ratchet(secret []byte) error {
+	cipher, err := updateKey(d.cipher, secret, d.ownsCipher)
+	if err != nil {
+		return err
+	}
+
+	d.cipher = cipher
+	d.ownsCipher = true
+	d.keyUpdated = true
+	d.ratchetChunks = 0
+	d.limits = usageLimits(cipher, d.sequentialNonce)
+	d.failedDecryptions = 0
+
+	return nil
+}
+
+// updateKey returns the cipher with the next key of a KeyUpdater cipher, and
+// destroys the current one if destroy is true.
+func updateKey(cipher Cipher, secret []byte, destroy bool) (Cipher, error) {
+	keyUpdater, ok := cipher.(KeyUpdater)
+	if !ok {
+		return nil, ErrKeyUpdateNotSupported
+	}
+
+	next, err := keyUpdater.UpdateKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if destroy {
+		err = destroyCipher(cipher)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return next, nil
+}
+
 func initNonce(nonceSize int, initiator bool) []byte {
 	b := make([]byte, nonceSize)
 	if !initiator {
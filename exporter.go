@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// exporterSecretInfo is the HKDF info used to derive exporter secret from
+	// the shared secret of a handshake.
+	exporterSecretInfo = "encrypted-stream exporter secret"
+
+	// exporterLabelPrefix is prepended to the label of ExportKeyingMaterial.
+	exporterLabelPrefix = "encrypted-stream exporter "
+
+	// maxExportedKeyingMaterialSize is the max output size of HKDF-SHA256.
+	maxExportedKeyingMaterialSize = 255 * sha256.Size
+)
+
+// ErrNoKeyingMaterial is returned by ExportKeyingMaterial if the stream is not
+// created by a handshake provided by this package.
+var ErrNoKeyingMaterial = errors.New("stream is not created by a handshake")
+
+// ExportKeyingMaterial returns length bytes of keying material derived from
+// the handshake that created the stream, similar to TLS keying material
+// exporter (RFC 5705 and RFC 8446). Two sides of the stream get the same
+// output for the same label and context, while different label, context or
+// stream produce independent output, so it can be used to bind application
+// level authentication to the stream (channel binding). Label should be
+// unique for each usage. Returns ErrNoKeyingMaterial if the stream is not
+// created by a handshake, or io.ErrClosedPipe if the stream is closed.
+func (es *EncryptedStream) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	es.lock.RLock()
+	defer es.lock.RUnlock()
+
+	if es.isClosed {
+		return nil, io.ErrClosedPipe
+	}
+
+	if es.exporterSecret == nil {
+		return nil, ErrNoKeyingMaterial
+	}
+
+	if length < 0 || length > maxExportedKeyingMaterialSize {
+		return nil, errors.New("invalid keying material length")
+	}
+
+	secret, err := deriveSecret(es.exporterSecret, nil, exporterLabelPrefix+label)
+	if err != nil {
+		return nil, err
+	}
+
+	contextHash := sha256.Sum256(context)
+	r := hkdf.Expand(sha256.New, secret, contextHash[:])
+
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// TranscriptHash returns the hash of the handshake transcript that created the
+// stream, which is the same on both sides and unique for every handshake. It
+// is public information and can be used as a channel binding identifier, but
+// it should not be used as secret; use ExportKeyingMaterial instead. Returns
+// nil if the stream is not created by a handshake.
+func (es *EncryptedStream) TranscriptHash() []byte {
+	return es.transcriptHash
+}
+
+// setExporter derives exporter secret of the stream from the shared secret and
+// the transcript hash of a handshake.
+func (es *EncryptedStream) setExporter(secret, th []byte) error {
+	exporterSecret, err := deriveSecret(secret, th, exporterSecretInfo)
+	if err != nil {
+		return err
+	}
+
+	es.exporterSecret = exporterSecret
+	es.transcriptHash = append([]byte(nil), th...)
+
+	return nil
+}
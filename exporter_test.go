@@ -0,0 +1,139 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func exporterTest(t *testing.T, aliceHandshake, bobHandshake handshakeFunc) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, aliceHandshake, bobHandshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(aliceEncrypted.TranscriptHash()) == 0 || !bytes.Equal(aliceEncrypted.TranscriptHash(), bobEncrypted.TranscriptHash()) {
+		t.Fatal("transcript hash mismatch")
+	}
+
+	aliceEKM, err := aliceEncrypted.ExportKeyingMaterial("test", []byte("context"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobEKM, err := bobEncrypted.ExportKeyingMaterial("test", []byte("context"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(aliceEKM) != 64 || !bytes.Equal(aliceEKM, bobEKM) {
+		t.Fatal("exported keying material mismatch")
+	}
+
+	otherLabel, err := aliceEncrypted.ExportKeyingMaterial("other", []byte("context"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherContext, err := aliceEncrypted.ExportKeyingMaterial("test", nil, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(aliceEKM, otherLabel) || bytes.Equal(aliceEKM, otherContext) {
+		t.Fatal("exported keying material should depend on label and context")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportKeyingMaterialHandshake(t *testing.T) {
+	exporterTest(t, handshake(HandshakeConfig{Initiator: true}), handshake(HandshakeConfig{}))
+}
+
+func TestExportKeyingMaterialNoise(t *testing.T) {
+	aliceKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporterTest(t, noiseHandshake(NoiseConfig{Initiator: true, StaticPrivateKey: aliceKey}), noiseHandshake(NoiseConfig{StaticPrivateKey: bobKey}))
+}
+
+func TestExportKeyingMaterialPAKE(t *testing.T) {
+	password := []byte("123456")
+	exporterTest(t, pakeHandshake(PAKEConfig{Initiator: true, Password: password}), pakeHandshake(PAKEConfig{Password: password}))
+}
+
+func TestExportKeyingMaterialPSK(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyLookup := func(id []byte) ([]byte, error) {
+		return key, nil
+	}
+
+	exporterTest(t, pskHandshake(PSKConfig{Initiator: true, Key: key}), pskHandshake(PSKConfig{KeyLookup: keyLookup}))
+}
+
+func TestExportKeyingMaterialUnique(t *testing.T) {
+	var ekm [][]byte
+	for i := 0; i < 2; i++ {
+		alice, bob, err := createPipe(false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aliceEncrypted, _, err := handshakePair(alice, bob, handshake(HandshakeConfig{Initiator: true}), handshake(HandshakeConfig{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := aliceEncrypted.ExportKeyingMaterial("test", nil, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ekm = append(ekm, b)
+	}
+
+	if bytes.Equal(ekm[0], ekm[1]) {
+		t.Fatal("exported keying material should be unique for every stream")
+	}
+}
+
+func TestExportKeyingMaterialNoHandshake(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, _, err := createEncryptedStreamPair(alice, bob, cc20p1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = aliceEncrypted.ExportKeyingMaterial("test", nil, 32)
+	if err != ErrNoKeyingMaterial {
+		t.Fatalf("expect error %v, got %v", ErrNoKeyingMaterial, err)
+	}
+
+	if aliceEncrypted.TranscriptHash() != nil {
+		t.Fatal("transcript hash should be nil")
+	}
+}
@@ -1,9 +1,14 @@
 module github.com/nknorg/encrypted-stream
 
-go 1.12
+go 1.24
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/imdario/mergo v0.3.9
 	golang.org/x/crypto v0.12.0
+)
+
+require (
+	golang.org/x/sys v0.11.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,1048 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// handshakeProtocolName identifies the handshake protocol and is the first
+	// thing mixed into handshake transcript.
+	handshakeProtocolName = "EncryptedStream_Handshake_25519_SHA256"
+
+	// sessionKeysInfo is the HKDF info used to derive session keys.
+	sessionKeysInfo = "encrypted-stream session keys"
+
+	// handshakeKeysInfo is the HKDF info used to derive handshake keys that
+	// protect identities during handshake.
+	handshakeKeysInfo = "encrypted-stream handshake keys"
+
+	// handshakeInitiatorSignatureContext and handshakeResponderSignatureContext
+	// are prepended to the data signed by initiator and responder.
+	handshakeInitiatorSignatureContext = "encrypted-stream handshake initiator signature"
+	handshakeResponderSignatureContext = "encrypted-stream handshake responder signature"
+
+	// resumptionSecretInfo is the HKDF info used to derive resumption secret
+	// sealed in session ticket.
+	resumptionSecretInfo = "encrypted-stream resumption secret"
+
+	// resumptionConfirmationInfo is the HKDF info used to derive the key of
+	// responder's confirmation of a resumed session.
+	resumptionConfirmationInfo = "encrypted-stream resumption confirmation"
+
+	// sessionTicketKeyInfo is the HKDF info used to derive the key that
+	// protects new session ticket message.
+	sessionTicketKeyInfo = "encrypted-stream session ticket message"
+
+	// sessionKeySize is the size of each derived session key.
+	sessionKeySize = 32
+
+	// maxHandshakeMessageSize is the max size of a single handshake message.
+	maxHandshakeMessageSize = 65536
+)
+
+// HandshakeConfig is the configuration for Handshake.
+type HandshakeConfig struct {
+	// Initiator indicates the direction of the handshake (initiator or
+	// responder). Two sides of the handshake should set this to different value.
+	// Initiator sends the first handshake message, and becomes the stream
+	// initiator after handshake.
+	Initiator bool
+
+	// KeyExchange is the ephemeral key exchange algorithm. Both sides should use
+	// the same algorithm. Default is KeyExchangeX25519.
+	KeyExchange KeyExchange
+
+	// PrivateKey is the Ed25519 private key that identifies the local side. If
+	// not nil, the handshake transcript will be signed by it so that peer can
+	// authenticate the local side, and peer is required to do the same. Both
+	// sides should either set or not set this.
+	PrivateKey ed25519.PrivateKey
+
+	// VerifyPeerPublicKey, if not nil, is called with peer's Ed25519 public key
+	// after peer's signature is verified. Returning a non-nil error will abort
+	// the handshake. If nil, any peer public key will be accepted, and
+	// application should check PeerPublicKey() of the created stream instead.
+	// It requires PrivateKey, as peer is not authenticated without it.
+	VerifyPeerPublicKey func(peerPublicKey ed25519.PublicKey) error
+
+	// Credentials is the credential chain of PrivateKey (see Credential) that
+	// will be sent to peer together with the public key. The subject of the
+	// first credential should be the public key of PrivateKey. It is only used
+	// when PrivateKey is not nil.
+	Credentials []*Credential
+
+	// TrustRoots, if not empty, requires peer to present a credential chain
+	// that is issued by one of the trust roots and has not expired. The
+	// attributes of peer's first credential are available through
+	// PeerAttributes of the created stream. It requires PrivateKey, as peer is
+	// not authenticated without it.
+	TrustRoots []ed25519.PublicKey
+
+	// CipherSuites is the list of cipher suites that can be used by the
+	// created stream, in order of preference. Initiator offers all of them, and
+	// responder selects the first one in its own list that is offered by
+	// initiator. If empty, DefaultCipherSuites() will be used. Cipher suites
+	// that do not support additional data (XSalsa20-Poly1305) are skipped when
+	// Config.AuthenticateHeader or Config.EncryptLength is true. The selected
+	// suite is available through CipherSuite of the created stream.
+	CipherSuites []CipherSuite
+
+	// SessionTicketKeys, if not nil, is used by responder to issue session
+	// tickets at the end of handshake, and to open session tickets presented by
+	// initiator. Only used by responder.
+	SessionTicketKeys *SessionTicketKeys
+
+	// SessionTicket is a session ticket got from SessionTicket() of a stream
+	// created by a previous handshake with the same responder. If not empty,
+	// initiator presents it to resume the previous session, skipping key
+	// exchange and authentication, and deriving fresh session keys from the
+	// previous session's resumption secret. If responder rejects it, a full
+	// handshake is performed. Resumed session does not have the forward secrecy
+	// of a full handshake with respect to the ticket key and the resumption
+	// secret, so the ticket should be stored as securely as a private key. Only
+	// used by initiator.
+	SessionTicket []byte
+
+	// Config is the config of the encrypted stream created after handshake. It
+	// will be merged with the default config. Cipher, Initiator and
+	// SequentialNonce will be set by handshake and should be left empty.
+	Config *Config
+}
+
+// Handshake performs an ephemeral X25519 (or hybrid X25519 and ML-KEM-768, see
+// HandshakeConfig.KeyExchange) key exchange over the given ReadWriter, derives
+// a separate key for each direction using HKDF, and creates an EncryptedStream
+// with the derived keys.
+//
+// If HandshakeConfig.PrivateKey is nil, Handshake does not authenticate the
+// peer, so it only protects against passive attackers unless peer is
+// authenticated by other means. Otherwise, a SIGMA-style authentication is
+// performed: each side encrypts its Ed25519 public key and its signature of the
+// handshake transcript with a key derived from the ephemeral key exchange, and
+// the authenticated peer public key is available through PeerPublicKey of the
+// created stream.
+//
+// If responder sets HandshakeConfig.SessionTicketKeys, it issues a session
+// ticket at the end of handshake, which initiator can get from SessionTicket
+// of the created stream and present in a later handshake to skip the key
+// exchange and authentication. See HandshakeConfig.SessionTicket.
+func Handshake(conn io.ReadWriter, config *HandshakeConfig) (*EncryptedStream, error) {
+	if config == nil {
+		return nil, errors.New("nil handshake config")
+	}
+
+	if config.PrivateKey != nil && len(config.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("private key should be %d bytes", ed25519.PrivateKeySize)
+	}
+
+	if len(config.Credentials) > 0 && (config.PrivateKey == nil || !config.Credentials[0].Subject.Equal(config.PrivateKey.Public())) {
+		return nil, errors.New("credential subject does not match private key")
+	}
+
+	if config.VerifyPeerPublicKey != nil && config.PrivateKey == nil {
+		return nil, errors.New("VerifyPeerPublicKey requires PrivateKey")
+	}
+
+	if len(config.TrustRoots) > 0 && config.PrivateKey == nil {
+		return nil, errors.New("TrustRoots requires PrivateKey")
+	}
+
+	for _, s := range config.CipherSuites {
+		if s.KeySize() == 0 {
+			return nil, fmt.Errorf("unknown cipher suite %v", s)
+		}
+	}
+
+	ks, err := newKeyShare(config.KeyExchange)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := newStreamParameters(config.Config, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &handshakeState{
+		conn:       conn,
+		config:     config,
+		transcript: newTranscript(handshakeProtocolName),
+		keyShare:   ks,
+		params:     params,
+	}
+	hs.transcript.add([]byte(config.KeyExchange.String()))
+
+	if len(hs.cipherSuites()) == 0 {
+		return nil, ErrAdditionalDataNotSupported
+	}
+
+	if config.Initiator {
+		err = hs.runInitiator()
+	} else {
+		err = hs.runResponder()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := deriveSessionKeys(hs.masterSecret, hs.finalTranscript, config.Initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := newHandshakeStream(conn, config.Config, config.Initiator, hs.cipherSuite, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = es.setExporter(hs.masterSecret, hs.finalTranscript)
+	if err != nil {
+		return nil, err
+	}
+
+	es.peerPublicKey = hs.peerPublicKey
+	es.peerAttributes = hs.peerAttributes
+	es.resumed = hs.resumed
+	if hs.clientSession != nil {
+		es.sessionTicket, err = hs.clientSession.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return es, nil
+}
+
+// Handshake message extension types. Each handshake message starts with a key
+// share field (possibly empty), followed by extension fields, each of which
+// starts with an extension type byte.
+const (
+	extensionIdentity byte = iota + 1
+	extensionSessionTicket
+	extensionResumed
+	extensionNewSessionTicket
+	extensionCipherSuites
+	extensionCipherSuite
+	extensionStreamParameters
+)
+
+// handshakeState is the state of a single Handshake.
+type handshakeState struct {
+	conn       io.ReadWriter
+	config     *HandshakeConfig
+	transcript *transcript
+
+	keyShare      *keyShare
+	params        *streamParameters
+	cipherSuite   CipherSuite
+	handshakeKeys *sessionKeys
+
+	peerPublicKey   ed25519.PublicKey
+	peerCredentials []byte
+	peerAttributes  map[string]string
+
+	// masterSecret is the shared secret of key exchange, or the resumption
+	// secret of a resumed session.
+	masterSecret    []byte
+	finalTranscript []byte
+	resumed         bool
+	clientSession   *clientSession
+}
+
+func (hs *handshakeState) runInitiator() error {
+	share := hs.keyShare.initiatorShare()
+	offered := hs.cipherSuites()
+	params := hs.params.marshal()
+	fields := [][]byte{
+		share,
+		extension(extensionCipherSuites, marshalCipherSuites(offered)),
+		extension(extensionStreamParameters, params),
+	}
+
+	var session *clientSession
+	if len(hs.config.SessionTicket) > 0 {
+		s, err := unmarshalClientSession(hs.config.SessionTicket)
+		if err == nil && time.Now().Before(s.expiry) && (hs.config.PrivateKey == nil || (s.peerPublicKey != nil && hs.verifyCredentials(s.peerPublicKey, s.peerCredentials) == nil)) {
+			session = s
+			fields = append(fields, extension(extensionSessionTicket, session.ticket))
+		}
+	}
+
+	err := writeHandshakeMessage(hs.conn, fields...)
+	if err != nil {
+		return err
+	}
+
+	hs.transcript.add(share)
+	if session != nil {
+		hs.transcript.add(session.ticket)
+	}
+	hs.transcript.add(marshalCipherSuites(offered), params)
+
+	fields, err = readHandshakeMessage(hs.conn, 0)
+	if err != nil {
+		return err
+	}
+
+	if len(fields) == 0 {
+		return ErrNoCommonCipherSuite
+	}
+
+	extensions, err := parseExtensions(fields[1:])
+	if err != nil {
+		return err
+	}
+
+	selected, err := unmarshalCipherSuites(extensions[extensionCipherSuite])
+	if err != nil || len(selected) != 1 {
+		return errors.New("invalid selected cipher suite")
+	}
+
+	if _, err = selectCipherSuite(selected, offered); err != nil {
+		return fmt.Errorf("peer selected cipher suite %v that is not offered", selected[0])
+	}
+
+	hs.cipherSuite = selected[0]
+	hs.params.cipherSuite = hs.cipherSuite
+
+	err = hs.params.check(extensions[extensionStreamParameters])
+	if err != nil {
+		return err
+	}
+
+	hs.transcript.add(marshalCipherSuites(selected), extensions[extensionStreamParameters])
+
+	if resumed, ok := extensions[extensionResumed]; ok {
+		if session == nil {
+			return errors.New("unexpected session resumption")
+		}
+		err = hs.resume(session.resumptionSecret, session.peerPublicKey, session.peerCredentials, resumed)
+		if err != nil {
+			return err
+		}
+	} else {
+		sharedSecret, err := hs.keyShare.finish(fields[0])
+		if err != nil {
+			return err
+		}
+
+		err = hs.keyExchange(fields[0], sharedSecret)
+		if err != nil {
+			return err
+		}
+
+		identity, ok := extensions[extensionIdentity]
+		if hs.config.PrivateKey == nil {
+			if ok {
+				return errors.New("peer requires authentication but private key is not set")
+			}
+		} else {
+			if !ok {
+				return errors.New("peer is not authenticated")
+			}
+
+			err = hs.openIdentity(identity)
+			if err != nil {
+				return err
+			}
+
+			identity, err := hs.sealIdentity()
+			if err != nil {
+				return err
+			}
+
+			err = writeHandshakeMessage(hs.conn, identity)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	hs.finish()
+
+	if _, ok := extensions[extensionNewSessionTicket]; ok {
+		return hs.readNewSessionTicket()
+	}
+
+	return nil
+}
+
+func (hs *handshakeState) runResponder() error {
+	fields, err := readHandshakeMessage(hs.conn, 1)
+	if err != nil {
+		return err
+	}
+
+	extensions, err := parseExtensions(fields[1:])
+	if err != nil {
+		return err
+	}
+
+	hs.transcript.add(fields[0])
+
+	ticket, hasTicket := extensions[extensionSessionTicket]
+	if hasTicket {
+		hs.transcript.add(ticket)
+	}
+
+	offered, err := unmarshalCipherSuites(extensions[extensionCipherSuites])
+	if err != nil {
+		return err
+	}
+	hs.transcript.add(extensions[extensionCipherSuites], extensions[extensionStreamParameters])
+
+	hs.cipherSuite, err = selectCipherSuite(hs.cipherSuites(), offered)
+	if err != nil {
+		writeHandshakeMessage(hs.conn)
+		return err
+	}
+
+	selected := marshalCipherSuites([]CipherSuite{hs.cipherSuite})
+	hs.params.cipherSuite = hs.cipherSuite
+	params := hs.params.marshal()
+
+	// Reply with local parameters on mismatch so that initiator gets the same
+	// error.
+	err = hs.params.check(extensions[extensionStreamParameters])
+	if err != nil {
+		writeHandshakeMessage(hs.conn, nil, extension(extensionCipherSuite, selected), extension(extensionStreamParameters, params))
+		return err
+	}
+
+	hs.transcript.add(selected, params)
+
+	ticketKeys := hs.config.SessionTicketKeys
+
+	var state *sessionTicketState
+	if hasTicket && ticketKeys != nil {
+		state, err = ticketKeys.open(ticket)
+		if err != nil || (hs.config.PrivateKey != nil && (state.peerPublicKey == nil || hs.verifyCredentials(state.peerPublicKey, state.peerCredentials) != nil)) {
+			state = nil
+		}
+	}
+
+	var reply [][]byte
+	if state != nil {
+		resumed, err := hs.acceptResumption(state)
+		if err != nil {
+			return err
+		}
+		reply = [][]byte{nil, extension(extensionCipherSuite, selected), extension(extensionStreamParameters, params), extension(extensionResumed, resumed)}
+	} else {
+		share, sharedSecret, err := hs.keyShare.respond(fields[0])
+		if err != nil {
+			return err
+		}
+
+		err = hs.keyExchange(share, sharedSecret)
+		if err != nil {
+			return err
+		}
+
+		reply = [][]byte{share, extension(extensionCipherSuite, selected), extension(extensionStreamParameters, params)}
+		if hs.config.PrivateKey != nil {
+			identity, err := hs.sealIdentity()
+			if err != nil {
+				return err
+			}
+			reply = append(reply, extension(extensionIdentity, identity))
+		}
+	}
+
+	if ticketKeys != nil {
+		reply = append(reply, extension(extensionNewSessionTicket, nil))
+	}
+
+	err = writeHandshakeMessage(hs.conn, reply...)
+	if err != nil {
+		return err
+	}
+
+	if state == nil && hs.config.PrivateKey != nil {
+		fields, err = readHandshakeMessage(hs.conn, 1)
+		if err != nil {
+			return err
+		}
+
+		err = hs.openIdentity(fields[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	hs.finish()
+
+	if ticketKeys != nil {
+		return hs.writeNewSessionTicket()
+	}
+
+	return nil
+}
+
+// cipherSuites returns the configured cipher suites, or the default ones if
+// not configured. Cipher suites without additional data support are excluded if
+// the stream authenticates header or encrypts length, so that they are neither
+// offered nor accepted.
+func (hs *handshakeState) cipherSuites() []CipherSuite {
+	suites := hs.config.CipherSuites
+	if len(suites) == 0 {
+		suites = DefaultCipherSuites()
+	}
+
+	if !hs.params.authenticateHeader && !hs.params.encryptLength {
+		return suites
+	}
+
+	supported := make([]CipherSuite, 0, len(suites))
+	for _, s := range suites {
+		if s.supportsAdditionalData() {
+			supported = append(supported, s)
+		}
+	}
+
+	return supported
+}
+
+// keyExchange mixes responder's key share into transcript, and derives
+// handshake keys used to protect identities from the shared secret.
+func (hs *handshakeState) keyExchange(responderShare, sharedSecret []byte) error {
+	hs.transcript.add(responderShare)
+	hs.masterSecret = sharedSecret
+
+	var err error
+	hs.handshakeKeys, err = deriveDirectionalKeys(sharedSecret, hs.transcript.sum(), handshakeKeysInfo, hs.config.Initiator)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// finish records the final handshake transcript. Session keys and resumption
+// secret are derived from master secret and final transcript.
+func (hs *handshakeState) finish() {
+	hs.finalTranscript = hs.transcript.sum()
+}
+
+// acceptResumption is called by responder to resume the session of a valid
+// ticket. It returns the content of resumed extension: a random nonce and the
+// responder's confirmation that it has the resumption secret.
+func (hs *handshakeState) acceptResumption(state *sessionTicketState) ([]byte, error) {
+	if hs.config.PrivateKey != nil && hs.config.VerifyPeerPublicKey != nil {
+		err := hs.config.VerifyPeerPublicKey(state.peerPublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nonce := make([]byte, sessionKeySize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.transcript.add(nonce)
+	hs.masterSecret = state.resumptionSecret
+	hs.peerPublicKey = state.peerPublicKey
+	hs.peerCredentials = state.peerCredentials
+	hs.resumed = true
+
+	confirmation, err := resumptionConfirmation(hs.masterSecret, hs.transcript.sum())
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nonce, confirmation...), nil
+}
+
+// resume is called by initiator when responder accepts its session ticket.
+func (hs *handshakeState) resume(resumptionSecret []byte, peerPublicKey ed25519.PublicKey, peerCredentials, resumed []byte) error {
+	if len(resumed) <= sessionKeySize {
+		return errors.New("invalid resumed extension")
+	}
+
+	hs.transcript.add(resumed[:sessionKeySize])
+
+	confirmation, err := resumptionConfirmation(resumptionSecret, hs.transcript.sum())
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(confirmation, resumed[sessionKeySize:]) {
+		return errors.New("invalid resumption confirmation")
+	}
+
+	if hs.config.PrivateKey != nil && hs.config.VerifyPeerPublicKey != nil {
+		err = hs.config.VerifyPeerPublicKey(peerPublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	hs.masterSecret = resumptionSecret
+	hs.peerPublicKey = peerPublicKey
+	hs.peerCredentials = peerCredentials
+	hs.resumed = true
+
+	return nil
+}
+
+// writeNewSessionTicket is called by responder to issue a session ticket after
+// handshake.
+func (hs *handshakeState) writeNewSessionTicket() error {
+	resumptionSecret, err := deriveSecret(hs.masterSecret, hs.finalTranscript, resumptionSecretInfo)
+	if err != nil {
+		return err
+	}
+
+	ticketKeys := hs.config.SessionTicketKeys
+	ticket, err := ticketKeys.seal(&sessionTicketState{
+		issued:           time.Now(),
+		resumptionSecret: resumptionSecret,
+		peerPublicKey:    hs.peerPublicKey,
+		peerCredentials:  hs.peerCredentials,
+	})
+	if err != nil {
+		return err
+	}
+
+	var lifetime [8]byte
+	binary.LittleEndian.PutUint64(lifetime[:], uint64(ticketKeys.ticketLifetime()/time.Second))
+
+	aead, err := hs.ticketAEAD()
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := marshalFields(ticket, lifetime[:])
+	if err != nil {
+		return err
+	}
+
+	return writeHandshakeMessage(hs.conn, aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, hs.finalTranscript))
+}
+
+// readNewSessionTicket is called by initiator to receive the session ticket
+// issued by responder.
+func (hs *handshakeState) readNewSessionTicket() error {
+	fields, err := readHandshakeMessage(hs.conn, 1)
+	if err != nil {
+		return err
+	}
+
+	aead, err := hs.ticketAEAD()
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), fields[0], hs.finalTranscript)
+	if err != nil {
+		return fmt.Errorf("decrypt failed: %v", err)
+	}
+
+	fields, err = unmarshalFields(plaintext)
+	if err != nil {
+		return err
+	}
+
+	if len(fields) != 2 || len(fields[1]) != 8 {
+		return errors.New("invalid new session ticket message")
+	}
+
+	resumptionSecret, err := deriveSecret(hs.masterSecret, hs.finalTranscript, resumptionSecretInfo)
+	if err != nil {
+		return err
+	}
+
+	lifetime := time.Duration(binary.LittleEndian.Uint64(fields[1])) * time.Second
+	hs.clientSession = &clientSession{
+		ticket:           fields[0],
+		resumptionSecret: resumptionSecret,
+		peerPublicKey:    hs.peerPublicKey,
+		peerCredentials:  hs.peerCredentials,
+		expiry:           time.Now().Add(lifetime),
+	}
+
+	return nil
+}
+
+// ticketAEAD returns the AEAD that protects new session ticket message.
+func (hs *handshakeState) ticketAEAD() (cipher.AEAD, error) {
+	key, err := deriveSecret(hs.masterSecret, hs.finalTranscript, sessionTicketKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// resumptionConfirmation computes responder's confirmation of a resumed
+// session.
+func resumptionConfirmation(resumptionSecret, th []byte) ([]byte, error) {
+	key, err := deriveSecret(resumptionSecret, th, resumptionConfirmationInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(th)
+
+	return mac.Sum(nil), nil
+}
+
+// extension returns a handshake message extension field.
+func extension(extensionType byte, data []byte) []byte {
+	return append([]byte{extensionType}, data...)
+}
+
+// parseExtensions parses handshake message extension fields.
+func parseExtensions(fields [][]byte) (map[byte][]byte, error) {
+	extensions := make(map[byte][]byte, len(fields))
+	for _, field := range fields {
+		if len(field) == 0 {
+			return nil, errors.New("invalid handshake message extension")
+		}
+		if _, ok := extensions[field[0]]; ok {
+			return nil, fmt.Errorf("duplicated handshake message extension %d", field[0])
+		}
+		extensions[field[0]] = field[1:]
+	}
+	return extensions, nil
+}
+
+// sealIdentity signs the current transcript and returns the local public key
+// and signature encrypted by handshake key.
+func (hs *handshakeState) sealIdentity() ([]byte, error) {
+	th := hs.transcript.sum()
+	publicKey := hs.config.PrivateKey.Public().(ed25519.PublicKey)
+	signature := ed25519.Sign(hs.config.PrivateKey, signedTranscript(th, publicKey, hs.config.Initiator))
+
+	plaintext := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize)
+	plaintext = append(plaintext, publicKey...)
+	plaintext = append(plaintext, signature...)
+	if len(hs.config.Credentials) > 0 {
+		chain, err := marshalCredentialChain(hs.config.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		plaintext = append(plaintext, chain...)
+	}
+
+	aead, err := chacha20poly1305.New(hs.handshakeKeys.encryptKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.transcript.add(plaintext)
+
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, th), nil
+}
+
+// openIdentity decrypts peer's public key, signature and optional credential
+// chain, and verifies them against the current transcript and trust roots.
+func (hs *handshakeState) openIdentity(ciphertext []byte) error {
+	th := hs.transcript.sum()
+
+	aead, err := chacha20poly1305.New(hs.handshakeKeys.decryptKey)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, th)
+	if err != nil {
+		return fmt.Errorf("decrypt failed: %v", err)
+	}
+
+	if len(plaintext) < ed25519.PublicKeySize+ed25519.SignatureSize {
+		return errors.New("invalid peer identity size")
+	}
+
+	peerPublicKey := ed25519.PublicKey(plaintext[:ed25519.PublicKeySize])
+	signature := plaintext[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	if !ed25519.Verify(peerPublicKey, signedTranscript(th, peerPublicKey, !hs.config.Initiator), signature) {
+		return errors.New("invalid peer signature")
+	}
+
+	peerCredentials := plaintext[ed25519.PublicKeySize+ed25519.SignatureSize:]
+	err = hs.verifyCredentials(peerPublicKey, peerCredentials)
+	if err != nil {
+		return err
+	}
+
+	if hs.config.VerifyPeerPublicKey != nil {
+		err = hs.config.VerifyPeerPublicKey(peerPublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	hs.peerPublicKey = peerPublicKey
+	hs.peerCredentials = peerCredentials
+	hs.transcript.add(plaintext)
+
+	return nil
+}
+
+// verifyCredentials verifies peer's encoded credential chain against trust
+// roots if there is any, and sets peer attributes.
+func (hs *handshakeState) verifyCredentials(peerPublicKey ed25519.PublicKey, peerCredentials []byte) error {
+	if len(hs.config.TrustRoots) == 0 {
+		return nil
+	}
+
+	chain, err := unmarshalCredentialChain(peerCredentials)
+	if err != nil {
+		return err
+	}
+
+	attributes, err := VerifyCredentialChain(chain, peerPublicKey, hs.config.TrustRoots, time.Now())
+	if err != nil {
+		return err
+	}
+
+	hs.peerAttributes = attributes
+
+	return nil
+}
+
+// signedTranscript returns the data to be signed by initiator or responder.
+func signedTranscript(th, publicKey []byte, initiator bool) []byte {
+	context := handshakeResponderSignatureContext
+	if initiator {
+		context = handshakeInitiatorSignatureContext
+	}
+
+	b := make([]byte, 0, len(context)+len(th)+len(publicKey))
+	b = append(b, context...)
+	b = append(b, th...)
+	b = append(b, publicKey...)
+
+	return b
+}
+
+// sessionKeys is the keys derived from a handshake.
+type sessionKeys struct {
+	encryptKey []byte
+	decryptKey []byte
+}
+
+// deriveSessionKeys derives session keys from a shared secret and a salt
+// (usually the handshake transcript hash) using HKDF-SHA256.
+func deriveSessionKeys(secret, salt []byte, initiator bool) (*sessionKeys, error) {
+	return deriveDirectionalKeys(secret, salt, sessionKeysInfo, initiator)
+}
+
+// deriveDirectionalKeys derives a key for each direction from a shared secret
+// and a salt using HKDF-SHA256 with the given info.
+func deriveDirectionalKeys(secret, salt []byte, info string, initiator bool) (*sessionKeys, error) {
+	r := hkdf.New(sha256.New, secret, salt, []byte(info))
+
+	initiatorKey := make([]byte, sessionKeySize)
+	_, err := io.ReadFull(r, initiatorKey)
+	if err != nil {
+		return nil, err
+	}
+
+	responderKey := make([]byte, sessionKeySize)
+	_, err = io.ReadFull(r, responderKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if initiator {
+		return &sessionKeys{encryptKey: initiatorKey, decryptKey: responderKey}, nil
+	}
+	return &sessionKeys{encryptKey: responderKey, decryptKey: initiatorKey}, nil
+}
+
+// deriveSecret derives a single secret from a shared secret and a salt using
+// HKDF-SHA256 with the given info.
+func deriveSecret(secret, salt []byte, info string) ([]byte, error) {
+	r := hkdf.New(sha256.New, secret, salt, []byte(info))
+
+	b := make([]byte, sessionKeySize)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// newHandshakeStream creates an EncryptedStream from the keys derived by a
+// handshake.
+func newHandshakeStream(conn io.ReadWriter, config *Config, initiator bool, suite CipherSuite, keys *sessionKeys) (*EncryptedStream, error) {
+	config, err := MergeConfig(DefaultConfig(), config)
+	if err != nil {
+		return nil, err
+	}
+
+	if suite.KeySize() == 0 || suite.KeySize() > len(keys.encryptKey) {
+		return nil, fmt.Errorf("unsupported cipher suite %v", suite)
+	}
+
+	encryptCipher, err := suite.NewCipher(keys.encryptKey[:suite.KeySize()])
+	if err != nil {
+		return nil, err
+	}
+
+	decryptCipher, err := suite.NewCipher(keys.decryptKey[:suite.KeySize()])
+	if err != nil {
+		return nil, err
+	}
+
+	config.Cipher, err = newDirectionalCipher(encryptCipher, decryptCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Initiator = initiator
+	config.SequentialNonce = true
+
+	if config.EncryptLength {
+		config.LengthKey, err = deriveLengthKey(keys, initiator, config.LengthKey)
+		if err != nil {
+			return nil, err
+		}
+		defer erase(config.LengthKey)
+	}
+
+	es, err := NewEncryptedStream(conn, config)
+	if err != nil {
+		return nil, err
+	}
+
+	es.cipherSuite = suite
+
+	return es, nil
+}
+
+// generateX25519Key generates a random X25519 private key and its public key.
+func generateX25519Key() ([]byte, []byte, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return privateKey, publicKey, nil
+}
+
+// transcript is a running hash of all handshake messages.
+type transcript struct {
+	hash hash.Hash
+}
+
+// newTranscript creates a transcript with a given protocol label.
+func newTranscript(label string) *transcript {
+	t := &transcript{hash: sha256.New()}
+	t.add([]byte(label))
+	return t
+}
+
+// add mixes data into transcript. Each data is length prefixed so that
+// different splits of the same bytes result in different transcripts.
+func (t *transcript) add(data ...[]byte) {
+	var lenBuf [4]byte
+	for _, b := range data {
+		binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(b)))
+		t.hash.Write(lenBuf[:])
+		t.hash.Write(b)
+	}
+}
+
+// sum returns the current transcript hash.
+func (t *transcript) sum() []byte {
+	return t.hash.Sum(nil)
+}
+
+// writeHandshakeMessage writes a handshake message consists of the given fields
+// to writer.
+func writeHandshakeMessage(writer io.Writer, fields ...[]byte) error {
+	b, err := marshalFields(fields...)
+	if err != nil {
+		return err
+	}
+
+	if len(b) > maxHandshakeMessageSize {
+		return errors.New("handshake message too large")
+	}
+
+	return writeVarBytes(writer, b, nil)
+}
+
+// readHandshakeMessage reads a handshake message from reader and returns its
+// fields. Returns error if the message has less than minFields fields.
+func readHandshakeMessage(reader io.Reader, minFields int) ([][]byte, error) {
+	b := make([]byte, maxHandshakeMessageSize)
+	n, err := readVarBytes(reader, b, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := unmarshalFields(b[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) < minFields {
+		return nil, fmt.Errorf("handshake message has %d fields, expect at least %d", len(fields), minFields)
+	}
+
+	return fields, nil
+}
+
+// marshalFields encodes fields into bytes. Each field is prefixed by its 2
+// bytes little-endian length, so field should not be larger than 65535 bytes.
+func marshalFields(fields ...[]byte) ([]byte, error) {
+	size := 0
+	for _, field := range fields {
+		if len(field) > 65535 {
+			return nil, errors.New("encoded field too large")
+		}
+		size += 2 + len(field)
+	}
+
+	b := make([]byte, 0, size)
+	for _, field := range fields {
+		b = append(b, byte(len(field)), byte(len(field)>>8))
+		b = append(b, field...)
+	}
+
+	return b, nil
+}
+
+// unmarshalFields decodes bytes encoded by marshalFields.
+func unmarshalFields(b []byte) ([][]byte, error) {
+	var fields [][]byte
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errors.New("invalid encoded fields")
+		}
+		size := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+size {
+			return nil, errors.New("invalid encoded fields")
+		}
+		fields = append(fields, b[2:2+size])
+		b = b[2+size:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,228 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type handshakeFunc func(conn io.ReadWriter) (*EncryptedStream, error)
+
+func handshakePair(alice, bob io.ReadWriter, aliceHandshake, bobHandshake handshakeFunc) (*EncryptedStream, *EncryptedStream, error) {
+	type result struct {
+		stream *EncryptedStream
+		err    error
+	}
+
+	bobChan := make(chan result, 1)
+	go func() {
+		bobEncrypted, err := bobHandshake(bob)
+		if err != nil {
+			if c, ok := bob.(io.Closer); ok {
+				c.Close()
+			}
+		}
+		bobChan <- result{bobEncrypted, err}
+	}()
+
+	aliceEncrypted, err := aliceHandshake(alice)
+	if err != nil {
+		if c, ok := alice.(io.Closer); ok {
+			c.Close()
+		}
+	}
+
+	r := <-bobChan
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	return aliceEncrypted, r.stream, nil
+}
+
+func handshake(config HandshakeConfig) handshakeFunc {
+	return func(conn io.ReadWriter) (*EncryptedStream, error) {
+		return Handshake(conn, &config)
+	}
+}
+
+func TestHandshakePipe(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, handshake(HandshakeConfig{Initiator: true}), handshake(HandshakeConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeTCP(t *testing.T) {
+	alice, bob, err := createTCPConn(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, handshake(HandshakeConfig{Initiator: true}), handshake(HandshakeConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeLowOrderPoint(t *testing.T) {
+	alice, bob := net.Pipe()
+
+	go func() {
+		readHandshakeMessage(bob, 1)
+		writeHandshakeMessage(bob, make([]byte, 32))
+	}()
+
+	_, err := Handshake(alice, &HandshakeConfig{Initiator: true})
+	if err == nil {
+		t.Fatal("handshake with low order point should fail")
+	}
+}
+
+func TestHandshakeEd25519(t *testing.T) {
+	alicePub, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPub, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, PrivateKey: aliceKey}),
+		handshake(HandshakeConfig{PrivateKey: bobKey}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(aliceEncrypted.PeerPublicKey(), bobPub) {
+		t.Fatal("alice got wrong peer public key")
+	}
+
+	if !bytes.Equal(bobEncrypted.PeerPublicKey(), alicePub) {
+		t.Fatal("bob got wrong peer public key")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeEd25519RejectPeer(t *testing.T) {
+	_, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errRejected := errors.New("rejected")
+
+	alice, bob := net.Pipe()
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{
+			Initiator:  true,
+			PrivateKey: aliceKey,
+			VerifyPeerPublicKey: func(ed25519.PublicKey) error {
+				return errRejected
+			},
+		}),
+		handshake(HandshakeConfig{PrivateKey: bobKey}),
+	)
+	if err != errRejected {
+		t.Fatalf("expect error %v, got %v", errRejected, err)
+	}
+}
+
+func TestHandshakeEd25519Unauthenticated(t *testing.T) {
+	_, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := net.Pipe()
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, PrivateKey: aliceKey}),
+		handshake(HandshakeConfig{}),
+	)
+	if err == nil {
+		t.Fatal("handshake with unauthenticated peer should fail")
+	}
+}
+
+func TestHandshakeVerifyPeerWithoutPrivateKey(t *testing.T) {
+	alice, _ := net.Pipe()
+
+	// Peer would not be authenticated, so VerifyPeerPublicKey would never be
+	// called.
+	_, err := Handshake(alice, &HandshakeConfig{
+		Initiator: true,
+		VerifyPeerPublicKey: func(ed25519.PublicKey) error {
+			return errors.New("rejected")
+		},
+	})
+	if err == nil {
+		t.Fatal("VerifyPeerPublicKey without PrivateKey should be rejected")
+	}
+}
+
+func TestMarshalFieldsTooLarge(t *testing.T) {
+	_, err := marshalFields([]byte("ok"), make([]byte, 65536))
+	if err == nil {
+		t.Fatal("field larger than 65535 bytes should be rejected")
+	}
+
+	b, err := marshalFields([]byte("ok"), make([]byte, 65535))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := unmarshalFields(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fields) != 2 || len(fields[1]) != 65535 {
+		t.Fatal("decoded fields are different from original ones")
+	}
+}
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// lengthPrefixSize is the size of the length prefix of each encrypted chunk
+// written to the underlying stream.
+const lengthPrefixSize = 4
+
+// EnableHeaderAuthentication makes Encoder authenticate the size of each
+// encoded chunk, which is the length prefix written by EncryptedStream, and its
+// header before nonce (e.g. key ID) as additional data, so that framing can not
+// be modified without failing decryption. Cipher should implement
+// AdditionalDataCipher, otherwise ErrAdditionalDataNotSupported is returned.
+// The peer's Decoder should enable it as well.
+func (e *Encoder) EnableHeaderAuthentication() error {
+	if e.cipher == nil || !supportsAdditionalData(e.cipher) {
+		return ErrAdditionalDataNotSupported
+	}
+
+	e.authenticateHeader = true
+
+	return nil
+}
+
+// EnableHeaderAuthentication makes Decoder verify the size and header of each
+// chunk authenticated by the peer's Encoder. Cipher should implement
+// AdditionalDataCipher, otherwise ErrAdditionalDataNotSupported is returned.
+func (d *Decoder) EnableHeaderAuthentication() error {
+	if d.cipher == nil || !supportsAdditionalData(d.cipher) {
+		return ErrAdditionalDataNotSupported
+	}
+
+	d.authenticateHeader = true
+
+	return nil
+}
+
+// seal encrypts plaintext into chunk after its header and nonce, and
+// authenticates the chunk size and header if header authentication is enabled.
+func (e *Encoder) seal(chunk []byte, headerSize, nonceSize int, plaintext []byte) ([]byte, error) {
+	nonce := chunk[headerSize : headerSize+nonceSize]
+	if !e.authenticateHeader {
+		return e.cipher.Encrypt(chunk[headerSize+nonceSize:], plaintext, nonce)
+	}
+
+	c, ok := e.cipher.(AdditionalDataCipher)
+	if !ok {
+		return nil, ErrAdditionalDataNotSupported
+	}
+
+	chunkSize := headerSize + nonceSize + len(plaintext) + c.MaxOverhead()
+	encrypted, err := c.EncryptWithAdditionalData(chunk[headerSize+nonceSize:], plaintext, nonce, headerAdditionalData(chunkSize, chunk[:headerSize]))
+	if err != nil {
+		return nil, err
+	}
+
+	if headerSize+nonceSize+len(encrypted) != chunkSize {
+		return nil, errors.New("encrypted chunk size does not match authenticated size")
+	}
+
+	return encrypted, nil
+}
+
+// open decrypts ciphertext of a chunk of chunkSize bytes with the given header,
+// and verifies the chunk size and header if header authentication is enabled.
+func (d *Decoder) open(cipher Cipher, plaintext, ciphertext, nonce []byte, chunkSize int, header []byte) ([]byte, error) {
+	if !d.authenticateHeader {
+		return cipher.Decrypt(plaintext, ciphertext, nonce)
+	}
+
+	c, ok := cipher.(AdditionalDataCipher)
+	if !ok {
+		return nil, ErrAdditionalDataNotSupported
+	}
+
+	return c.DecryptWithAdditionalData(plaintext, ciphertext, nonce, headerAdditionalData(chunkSize, header))
+}
+
+// headerAdditionalData returns the additional data that authenticates the size
+// and header of a chunk.
+func headerAdditionalData(chunkSize int, header []byte) []byte {
+	b := make([]byte, lengthPrefixSize, lengthPrefixSize+len(header))
+	binary.LittleEndian.PutUint32(b, uint32(chunkSize))
+	return append(b, header...)
+}
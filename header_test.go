@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"testing"
+)
+
+func TestHeaderAuthentication(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, authenticateHeader := range []bool{false, true} {
+		encoder, err := NewEncoder(cipher, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder.EnableKeyID(1)
+
+		decoder, err := NewDecoder(cipher, false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder.EnableKeyID(1)
+
+		if authenticateHeader {
+			err = encoder.EnableHeaderAuthentication()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = decoder.EnableHeaderAuthentication()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The same key is registered under another ID.
+		err = decoder.AddKey(2, cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk, err := encoder.Encode(make([]byte, 128), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = decoder.Decode(make([]byte, 128), chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk[0] = 2
+		_, err = decoder.Decode(make([]byte, 128), chunk)
+		if authenticateHeader && err == nil {
+			t.Fatal("modified header should not be decrypted")
+		}
+		if !authenticateHeader && err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHeaderAuthenticationStream(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{AuthenticateHeader: true}
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, Config: config}),
+		handshake(HandshakeConfig{Config: config}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !aliceEncrypted.encoder.authenticateHeader || !bobEncrypted.decoder.authenticateHeader {
+		t.Fatal("header authentication should be enabled")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderAuthenticationNotSupported(t *testing.T) {
+	_, err := NewEncryptedStream(nil, &Config{Cipher: NewXSalsa20Poly1305Cipher(&[32]byte{}), AuthenticateHeader: true})
+	if err != ErrAdditionalDataNotSupported {
+		t.Fatalf("expect ErrAdditionalDataNotSupported, got %v", err)
+	}
+}
+
+func TestAuthenticateHeaderParameterMismatch(t *testing.T) {
+	parameterMismatchTest(
+		t,
+		handshake(HandshakeConfig{Initiator: true, Config: &Config{AuthenticateHeader: true}}),
+		handshake(HandshakeConfig{}),
+		"AuthenticateHeader",
+	)
+}
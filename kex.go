@@ -0,0 +1,166 @@
+package stream
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeyExchange is the ephemeral key exchange algorithm used by Handshake.
+type KeyExchange int
+
+const (
+	// KeyExchangeX25519 is the classical ephemeral X25519 key exchange.
+	KeyExchangeX25519 KeyExchange = iota
+
+	// KeyExchangeX25519MLKEM768 is a hybrid post-quantum key exchange that
+	// combines ephemeral X25519 with ML-KEM-768 (FIPS 203), in the same way as
+	// the X25519MLKEM768 group of TLS 1.3. The shared secret is secure as long
+	// as either X25519 or ML-KEM-768 is secure, which protects recorded traffic
+	// against future quantum computers (harvest now, decrypt later). It adds
+	// about 2KB to the handshake.
+	KeyExchangeX25519MLKEM768
+)
+
+func (kex KeyExchange) String() string {
+	switch kex {
+	case KeyExchangeX25519:
+		return "X25519"
+	case KeyExchangeX25519MLKEM768:
+		return "X25519MLKEM768"
+	default:
+		return fmt.Sprintf("KeyExchange(%d)", int(kex))
+	}
+}
+
+// keyShare is the local ephemeral keys of a key exchange.
+type keyShare struct {
+	kex              KeyExchange
+	x25519PrivateKey []byte
+	x25519PublicKey  []byte
+	mlkemKey         *mlkem.DecapsulationKey768
+}
+
+// newKeyShare generates random ephemeral keys for a key exchange.
+func newKeyShare(kex KeyExchange) (*keyShare, error) {
+	x25519PrivateKey := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(x25519PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var mlkemSeed []byte
+	if kex == KeyExchangeX25519MLKEM768 {
+		mlkemSeed = make([]byte, mlkem.SeedSize)
+		_, err = rand.Read(mlkemSeed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return newKeyShareFromSeed(kex, x25519PrivateKey, mlkemSeed)
+}
+
+// newKeyShareFromSeed creates ephemeral keys for a key exchange from a X25519
+// private key and a ML-KEM-768 seed (only used by hybrid key exchange).
+func newKeyShareFromSeed(kex KeyExchange, x25519PrivateKey, mlkemSeed []byte) (*keyShare, error) {
+	x25519PublicKey, err := curve25519.X25519(x25519PrivateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &keyShare{
+		kex:              kex,
+		x25519PrivateKey: x25519PrivateKey,
+		x25519PublicKey:  x25519PublicKey,
+	}
+
+	switch kex {
+	case KeyExchangeX25519:
+	case KeyExchangeX25519MLKEM768:
+		ks.mlkemKey, err = mlkem.NewDecapsulationKey768(mlkemSeed)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown key exchange %v", kex)
+	}
+
+	return ks, nil
+}
+
+// initiatorShare returns the key share that initiator sends to responder.
+func (ks *keyShare) initiatorShare() []byte {
+	if ks.kex == KeyExchangeX25519MLKEM768 {
+		b := append([]byte(nil), ks.mlkemKey.EncapsulationKey().Bytes()...)
+		return append(b, ks.x25519PublicKey...)
+	}
+	return ks.x25519PublicKey
+}
+
+// respond is called by responder with initiator's key share, and returns the
+// key share that responder sends to initiator and the shared secret.
+func (ks *keyShare) respond(peerShare []byte) ([]byte, []byte, error) {
+	if ks.kex != KeyExchangeX25519MLKEM768 {
+		sharedSecret, err := ks.x25519(peerShare)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ks.x25519PublicKey, sharedSecret, nil
+	}
+
+	if len(peerShare) != mlkem.EncapsulationKeySize768+curve25519.PointSize {
+		return nil, nil, errors.New("peer uses a different key exchange")
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(peerShare[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mlkemSecret, ciphertext := ek.Encapsulate()
+
+	x25519Secret, err := ks.x25519(peerShare[mlkem.EncapsulationKeySize768:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	share := append(ciphertext, ks.x25519PublicKey...)
+	sharedSecret := append(mlkemSecret, x25519Secret...)
+
+	return share, sharedSecret, nil
+}
+
+// finish is called by initiator with responder's key share, and returns the
+// shared secret.
+func (ks *keyShare) finish(peerShare []byte) ([]byte, error) {
+	if ks.kex != KeyExchangeX25519MLKEM768 {
+		return ks.x25519(peerShare)
+	}
+
+	if len(peerShare) != mlkem.CiphertextSize768+curve25519.PointSize {
+		return nil, errors.New("peer uses a different key exchange")
+	}
+
+	mlkemSecret, err := ks.mlkemKey.Decapsulate(peerShare[:mlkem.CiphertextSize768])
+	if err != nil {
+		return nil, err
+	}
+
+	x25519Secret, err := ks.x25519(peerShare[mlkem.CiphertextSize768:])
+	if err != nil {
+		return nil, err
+	}
+
+	return append(mlkemSecret, x25519Secret...), nil
+}
+
+func (ks *keyShare) x25519(peerPublicKey []byte) ([]byte, error) {
+	if len(peerPublicKey) != curve25519.PointSize {
+		return nil, errors.New("peer uses a different key exchange")
+	}
+	return curve25519.X25519(ks.x25519PrivateKey, peerPublicKey)
+}
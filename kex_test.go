@@ -0,0 +1,174 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// X25519 test vector from RFC 7748 section 6.1.
+const (
+	x25519AlicePrivateKey = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	x25519AlicePublicKey  = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	x25519BobPublicKey    = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	x25519SharedSecret    = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+)
+
+// ML-KEM-768 ciphertext encapsulated to the decapsulation key generated from
+// seed 0x00, 0x01, ..., 0x3f, and the resulting shared secret.
+const (
+	mlkem768Ciphertext = "" +
+		"45c57de517212ddb834db9b4ef683a6cb50295bb36f4fc509960c6fe0a6e6276" +
+		"9941aaa1ef58b123971bd1e625e4d6b0db2819ae4fbbd884725d27fd2753e80b" +
+		"d164ec5d5f5045c464a144ed362ca831550bf5532869e672cc533f5429805d6b" +
+		"25d19d024528171d9a66891ff431b97a667d2c59d04d3c5c50a2ed7810c45e98" +
+		"0f988bf10b4931a7a2cafe9942154b1807b48e3e1677b8c379dd9927bc5d5f19" +
+		"5dac20c32958b53d4e748f30cc44340b971cc90b54e46681380e24e9d65de9da" +
+		"d816a7b5937668812938e1843bab72514a39119f5142242b6dcbb28a9745f446" +
+		"f60cd1e1e399af5e8e6885f85b1a0f0b596b89b3df2bae29df1e31c590b4d193" +
+		"6320d3159b87061a33eeb9ed9b33c6e2a96de962fbab7c3fad3c3da2ee7ff5f7" +
+		"a6936de84eb81c8f13ec0dbae247773a2fd18663f82c01bb78f0d6cd01a6c5d3" +
+		"8922d062407a357e5895ea26927a176f25e8c11f896d3d178834e1d2cb14c5e3" +
+		"ff0e6ce01f9944829c99c8713f788cc7903aa654ee9f831af3b77762c14fe1ee" +
+		"2bd886d6c64430af44e3ae7ae98a945c56d5a343bfbb674878594ea4db32828a" +
+		"7347602b3f306b30e812cb717ebffc54e4b7c50c4d1b0884e05acb67e49f3753" +
+		"aded124569f7bd7770fb13fec181c6aa0c4165d5b2f4c6c0a72b471ae9d5e491" +
+		"da94d58e8180e9236b643eb4d38d0660753b801741e1e1bfabea5ef872eeedcc" +
+		"8d90cb3b22d632e4536ddde58b837054d38d75487f8d0ae749bbf4f84a336851" +
+		"f01726214444f718c756a666c0835baef6e0bfee940e99faf9b1f6439bc2f4ea" +
+		"8233cd71172353f75d441f61558e5db6c9d82d19d54b0ba3b2ca7e4c69dbbabc" +
+		"f944f360957a9235dd71adecde24c47cd2ba434be69a2371c0891c3e774b411e" +
+		"b225e557e2357c7b108e079b361fc5e3fccfb7571f3cf062af94b18291b5b6a0" +
+		"2ac69028910b401e62bbd23f7add5afb049fa4cc1a6c517c5da3cb2168d3c903" +
+		"d956bbb4bc1527b0fa454a7f6999535e13a3e2801d594323c42a3cb1421d1235" +
+		"1946710cba151db41ee318cebe0b69016ab1fd156e9546d6a5100adaa6a2228d" +
+		"8097e2a345a3e54e576ae8265c05788fccd55c906b1df2d0ec70dc9cba15d190" +
+		"d2fb46bd015e2da7e5ec26b4d559c449eecb10e6074a02158840b9d1554c0662" +
+		"84601bb57e873f798a9dc162647e390881eb55872bbda1ae64917076b4b68f60" +
+		"199ab3b9706b407ec663d4d9db4ce6dbbd4f635d067da05187660a65e617937d" +
+		"d7af6239e2dc9d78a976dd18c01fac9e1da7d9897eb6a728d65e30fd5a6768b2" +
+		"d0a989c278f4a370d5ea797070e4b5705b53992dec2206aa85fa1d8c7b37adca" +
+		"b6c019b87ed6c759265efe9e625387bea549041485ff77a300d5d580f23ed6d6" +
+		"42c663b2b6a366a17944db2fc959d6ebcfce3cb70ba1a6d68a96b659ddd6bdd1" +
+		"3ad6171d7aba956677c00a7be995786961ea03f3c29480983d9d062dc317c008" +
+		"2ccaf56e4f287981ea41847a97ab73200c7c9f679979519ff7bb5b997e8c8d30"
+	mlkem768SharedSecret = "b8b89133b5f0e737d06ca7d49a711d1638cfa0d06094bfea593727fe5dec5f49"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestKeyExchangeX25519KnownAnswer(t *testing.T) {
+	ks, err := newKeyShareFromSeed(KeyExchangeX25519, mustDecodeHex(t, x25519AlicePrivateKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(ks.initiatorShare(), mustDecodeHex(t, x25519AlicePublicKey)) {
+		t.Fatalf("wrong initiator share %x", ks.initiatorShare())
+	}
+
+	sharedSecret, err := ks.finish(mustDecodeHex(t, x25519BobPublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sharedSecret, mustDecodeHex(t, x25519SharedSecret)) {
+		t.Fatalf("wrong shared secret %x", sharedSecret)
+	}
+}
+
+func TestKeyExchangeX25519MLKEM768KnownAnswer(t *testing.T) {
+	seed := make([]byte, 64)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+
+	ks, err := newKeyShareFromSeed(KeyExchangeX25519MLKEM768, mustDecodeHex(t, x25519AlicePrivateKey), seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share := ks.initiatorShare()
+	if len(share) != 1184+32 || !bytes.Equal(share[1184:], mustDecodeHex(t, x25519AlicePublicKey)) {
+		t.Fatal("wrong initiator share")
+	}
+
+	peerShare := append(mustDecodeHex(t, mlkem768Ciphertext), mustDecodeHex(t, x25519BobPublicKey)...)
+	sharedSecret, err := ks.finish(peerShare)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(mustDecodeHex(t, mlkem768SharedSecret), mustDecodeHex(t, x25519SharedSecret)...)
+	if !bytes.Equal(sharedSecret, expected) {
+		t.Fatalf("wrong shared secret %x", sharedSecret)
+	}
+}
+
+func TestKeyExchangeX25519MLKEM768RoundTrip(t *testing.T) {
+	initiator, err := newKeyShare(KeyExchangeX25519MLKEM768)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder, err := newKeyShare(KeyExchangeX25519MLKEM768)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share, responderSecret, err := responder.respond(initiator.initiatorShare())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiatorSecret, err := initiator.finish(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(initiatorSecret, responderSecret) {
+		t.Fatal("shared secret mismatch")
+	}
+}
+
+func TestHandshakeX25519MLKEM768(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, KeyExchange: KeyExchangeX25519MLKEM768}),
+		handshake(HandshakeConfig{KeyExchange: KeyExchangeX25519MLKEM768}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeKeyExchangeMismatch(t *testing.T) {
+	alice, bob := net.Pipe()
+	_, _, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, KeyExchange: KeyExchangeX25519MLKEM768}),
+		handshake(HandshakeConfig{}),
+	)
+	if err == nil {
+		t.Fatal("handshake with different key exchange should fail")
+	}
+}
@@ -0,0 +1,243 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// keyIDSize is the size of key ID at the beginning of each chunk when key IDs
+// are enabled.
+const keyIDSize = 4
+
+var (
+	// ErrUnknownKeyID indicates a chunk encrypted with a key that is not in the
+	// keyring of Decoder is received, e.g. the key has been retired, or has not
+	// been added before the peer switches to it.
+	ErrUnknownKeyID = errors.New("unknown key ID")
+
+	// ErrKeyIDNotEnabled indicates key IDs are not enabled, see Config.KeyIDs.
+	ErrKeyIDNotEnabled = errors.New("key ID is not enabled")
+)
+
+// decoderKey is a key in the keyring of Decoder.
+type decoderKey struct {
+	cipher            Cipher
+	limits            UsageLimits
+	failedDecryptions uint64
+	lastSeen          time.Time
+}
+
+// EnableKeyID makes Encoder prepend keyID, the ID of its cipher, to each
+// chunk, so that the encryption key can be switched by SetKey without
+// coordinating with the peer. The peer's Decoder should enable key ID as well.
+// Key ID can not be used together with key update or ratchet.
+func (e *Encoder) EnableKeyID(keyID uint32) {
+	e.keyIDs = true
+	e.keyID = keyID
+}
+
+// SetKey switches the encryption key to cipher with the given key ID. The
+// peer's Decoder should have the key added by AddKey before receiving chunks
+// encrypted with it. Cipher should have the same nonce size as the current
+// one, and nonce continues from the current value.
+func (e *Encoder) SetKey(keyID uint32, cipher Cipher) error {
+	if !e.keyIDs {
+		return ErrKeyIDNotEnabled
+	}
+
+	if cipher.NonceSize() != e.cipher.NonceSize() {
+		return errors.New("cipher should have the same nonce size as the current one")
+	}
+
+	if e.authenticateHeader && !supportsAdditionalData(cipher) {
+		return ErrAdditionalDataNotSupported
+	}
+
+	e.cipher = cipher
+	e.keyID = keyID
+	e.ownsCipher = false
+	e.limits = usageLimits(cipher, e.sequentialNonce)
+	e.sealedChunks = 0
+	e.sealedBytes = 0
+
+	return nil
+}
+
+// KeyID returns the ID of the current encryption key, or zero if key ID is not
+// enabled.
+func (e *Encoder) KeyID() uint32 {
+	return e.keyID
+}
+
+// EnableKeyID makes Decoder read the key ID at the beginning of each chunk and
+// decrypt it with the key of that ID in its keyring, which initially contains
+// its cipher with keyID. Keys can be added by AddKey and removed by RetireKey
+// or RetireKeysNotSeenSince.
+func (d *Decoder) EnableKeyID(keyID uint32) {
+	d.keyringLock.Lock()
+	defer d.keyringLock.Unlock()
+
+	d.keyIDs = true
+	d.lastKeyID = keyID
+	d.keyring = map[uint32]*decoderKey{
+		keyID: {
+			cipher:   d.cipher,
+			limits:   d.limits,
+			lastSeen: time.Now(),
+		},
+	}
+}
+
+// AddKey adds cipher with the given key ID to the keyring, so that chunks
+// encrypted with it can be decrypted. Cipher should have the same nonce size as
+// the existing ones. It is safe to call AddKey concurrently with Decode.
+func (d *Decoder) AddKey(keyID uint32, cipher Cipher) error {
+	if !d.keyIDs {
+		return ErrKeyIDNotEnabled
+	}
+
+	if cipher.NonceSize() != d.cipher.NonceSize() {
+		return errors.New("cipher should have the same nonce size as the existing ones")
+	}
+
+	if d.authenticateHeader && !supportsAdditionalData(cipher) {
+		return ErrAdditionalDataNotSupported
+	}
+
+	d.keyringLock.Lock()
+	defer d.keyringLock.Unlock()
+
+	if _, ok := d.keyring[keyID]; ok {
+		return fmt.Errorf("key ID %d already exists", keyID)
+	}
+
+	d.keyring[keyID] = &decoderKey{
+		cipher:   cipher,
+		limits:   usageLimits(cipher, d.sequentialNonce),
+		lastSeen: time.Now(),
+	}
+
+	return nil
+}
+
+// RetireKey removes the key with the given ID from the keyring. It is safe to
+// call RetireKey concurrently with Decode.
+func (d *Decoder) RetireKey(keyID uint32) {
+	d.keyringLock.Lock()
+	defer d.keyringLock.Unlock()
+
+	delete(d.keyring, keyID)
+}
+
+// RetireKeysNotSeenSince removes the keys that have not been used to decrypt
+// any chunk since t (or added since t) from the keyring, except the key of the
+// last decrypted chunk. Returns the IDs of removed keys in ascending order. It
+// is safe to call RetireKeysNotSeenSince concurrently with Decode.
+func (d *Decoder) RetireKeysNotSeenSince(t time.Time) []uint32 {
+	d.keyringLock.Lock()
+	defer d.keyringLock.Unlock()
+
+	var retired []uint32
+	for keyID, key := range d.keyring {
+		if keyID != d.lastKeyID && key.lastSeen.Before(t) {
+			delete(d.keyring, keyID)
+			retired = append(retired, keyID)
+		}
+	}
+
+	sort.Slice(retired, func(i, j int) bool { return retired[i] < retired[j] })
+
+	return retired
+}
+
+// KeyIDs returns the IDs of keys in the keyring in ascending order.
+func (d *Decoder) KeyIDs() []uint32 {
+	d.keyringLock.Lock()
+	defer d.keyringLock.Unlock()
+
+	keyIDs := make([]uint32, 0, len(d.keyring))
+	for keyID := range d.keyring {
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i] < keyIDs[j] })
+
+	return keyIDs
+}
+
+// key returns the key of the given ID in the keyring.
+func (d *Decoder) key(keyID uint32) (*decoderKey, error) {
+	d.keyringLock.Lock()
+	defer d.keyringLock.Unlock()
+
+	key, ok := d.keyring[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKeyID, keyID)
+	}
+
+	return key, nil
+}
+
+// markKeySeen marks the key of the given ID as seen. It should only be called
+// after a chunk is decrypted with the key, as key ID itself is not
+// authenticated.
+func (d *Decoder) markKeySeen(keyID uint32, key *decoderKey) {
+	d.keyringLock.Lock()
+	defer d.keyringLock.Unlock()
+
+	key.lastSeen = time.Now()
+	d.lastKeyID = keyID
+}
+
+// SetEncryptionKey switches the encryption key of the stream to cipher with the
+// given key ID, without interrupting data flow. The peer should add the key by
+// AddDecryptionKey first. It requires Config.KeyIDs to be true, and cipher
+// should have the same nonce size and no larger overhead than Config.Cipher.
+func (es *EncryptedStream) SetEncryptionKey(keyID uint32, cipher Cipher) error {
+	if !es.config.KeyIDs {
+		return ErrKeyIDNotEnabled
+	}
+
+	if cipher.MaxOverhead() > es.config.Cipher.MaxOverhead() {
+		return errors.New("cipher overhead should not be larger than Config.Cipher")
+	}
+
+	err := es.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer es.unlockWrite()
+
+	return es.encoder.SetKey(keyID, cipher)
+}
+
+// AddDecryptionKey adds cipher with the given key ID to the keyring of the
+// stream, so that the peer can switch to it by SetEncryptionKey. It requires
+// Config.KeyIDs to be true, and cipher should have the same nonce size and no
+// larger overhead than Config.Cipher. It does not block on pending Read.
+func (es *EncryptedStream) AddDecryptionKey(keyID uint32, cipher Cipher) error {
+	if !es.config.KeyIDs {
+		return ErrKeyIDNotEnabled
+	}
+
+	if cipher.MaxOverhead() > es.config.Cipher.MaxOverhead() {
+		return errors.New("cipher overhead should not be larger than Config.Cipher")
+	}
+
+	return es.decoder.AddKey(keyID, cipher)
+}
+
+// RetireDecryptionKey removes the key with the given ID from the keyring of the
+// stream.
+func (es *EncryptedStream) RetireDecryptionKey(keyID uint32) {
+	es.decoder.RetireKey(keyID)
+}
+
+// RetireDecryptionKeysNotSeenSince removes the keys that are no longer used by
+// the peer since t from the keyring of the stream. See
+// Decoder.RetireKeysNotSeenSince.
+func (es *EncryptedStream) RetireDecryptionKeysNotSeenSince(t time.Time) []uint32 {
+	return es.decoder.RetireKeysNotSeenSince(t)
+}
@@ -0,0 +1,177 @@
+package stream
+
+import (
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := make([]byte, 32)
+	newKey := make([]byte, 32)
+	for _, key := range [][]byte{oldKey, newKey} {
+		_, err := rand.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldCipher, err := NewChaCha20Poly1305Cipher(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCipher, err := NewChaCha20Poly1305Cipher(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{Cipher: oldCipher, SequentialNonce: true, KeyIDs: true, KeyID: 1}
+	aliceConfig := config
+	aliceConfig.Initiator = true
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, newStream(aliceConfig), newStream(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<16)
+	_, err = rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readChan := make(chan error, 1)
+	go func() {
+		readChan <- read(bobEncrypted, data)
+	}()
+
+	// Switch key in the middle of data while bob is reading.
+	err = write(aliceEncrypted, data[:len(data)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bobEncrypted.AddDecryptionKey(2, newCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = aliceEncrypted.SetEncryptionKey(2, newCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = write(aliceEncrypted, data[len(data)/2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-readChan
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retired := bobEncrypted.RetireDecryptionKeysNotSeenSince(time.Now())
+	if !reflect.DeepEqual(retired, []uint32{1}) {
+		t.Fatalf("expect key 1 to be retired, got %v", retired)
+	}
+
+	if keyIDs := bobEncrypted.decoder.KeyIDs(); !reflect.DeepEqual(keyIDs, []uint32{2}) {
+		t.Fatalf("expect key 2 in keyring, got %v", keyIDs)
+	}
+
+	// Chunks encrypted with retired key are rejected.
+	err = aliceEncrypted.SetEncryptionKey(1, oldCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go write(aliceEncrypted, data)
+
+	_, err = bobEncrypted.Read(data)
+	if !errors.Is(err, ErrUnknownKeyID) {
+		t.Fatalf("expect ErrUnknownKeyID, got %v", err)
+	}
+	aliceEncrypted.Close()
+}
+
+func TestKeyRotationNotEnabled(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es, err := NewEncryptedStream(nil, &Config{Cipher: cipher})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = es.SetEncryptionKey(1, cipher); err != ErrKeyIDNotEnabled {
+		t.Fatalf("expect ErrKeyIDNotEnabled, got %v", err)
+	}
+
+	if err = es.AddDecryptionKey(1, cipher); err != ErrKeyIDNotEnabled {
+		t.Fatalf("expect ErrKeyIDNotEnabled, got %v", err)
+	}
+}
+
+func TestKeyRotationForgedKeyID(t *testing.T) {
+	oldCipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCipher, err := NewChaCha20Poly1305Cipher(append(make([]byte, 31), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoder, err := NewEncoder(newCipher, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.EnableKeyID(2)
+
+	decoder, err := NewDecoder(oldCipher, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.EnableKeyID(1)
+
+	err = decoder.AddKey(2, newCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk, err := encoder.Encode(make([]byte, 128), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decoder.Decode(make([]byte, 128), chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now()
+
+	// A forged chunk with the old key ID should not keep the old key alive.
+	chunk[0] = 1
+	_, err = decoder.Decode(make([]byte, 128), chunk)
+	if err == nil {
+		t.Fatal("forged chunk should not be decrypted")
+	}
+
+	retired := decoder.RetireKeysNotSeenSince(since)
+	if !reflect.DeepEqual(retired, []uint32{1}) {
+		t.Fatalf("expect key 1 to be retired, got %v", retired)
+	}
+}
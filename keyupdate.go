@@ -0,0 +1,201 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// frameTypeSize is the size of frame type at the beginning of each
+	// plaintext chunk when control frames are enabled.
+	frameTypeSize = 1
+
+	// maxControlFrameSize is the max payload size of a control frame, which is
+	// the size of an X25519 public key.
+	maxControlFrameSize = 32
+
+	// keyUpdateRequested is the key update frame flag that asks the peer to
+	// update its encryption key as well.
+	keyUpdateRequested byte = 1
+
+	// keyUpdateDHRekey is the key update frame flag indicating the secret of
+	// the DH rekey started by sender is mixed into the new key.
+	keyUpdateDHRekey byte = 2
+)
+
+// Frame types.
+const (
+	frameData byte = iota
+	frameKeyUpdate
+	frameDHRekeyRequest
+	frameDHRekeyResponse
+)
+
+// UpdateKey sends a key update frame and switches the encryption key to a new
+// key derived from the current one, and asks the peer to do the same. It
+// requires Config.KeyUpdate to be true. Key update is performed automatically
+// according to config, so calling UpdateKey is usually not needed.
+func (es *EncryptedStream) UpdateKey() error {
+	if !es.config.KeyUpdate {
+		return errors.New("key update is not enabled")
+	}
+
+	err := es.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer es.unlockWrite()
+
+	return es.updateEncryptionKey(true)
+}
+
+// maybeUpdateKey updates the encryption key before writing a data chunk of n
+// bytes if any key update limit is reached or the peer asks for it, and sends
+// pending DH rekey frames.
+func (es *EncryptedStream) maybeUpdateKey(n int) error {
+	err := es.maybeDHRekey()
+	if err != nil {
+		return err
+	}
+
+	requested := es.keyUpdateRequested.Swap(false)
+	limitReached := es.keyUpdateLimitReached(n)
+	if !requested && !limitReached {
+		return nil
+	}
+	return es.updateEncryptionKey(limitReached)
+}
+
+// keyUpdateLimitReached returns whether the current encryption key should not
+// be used to encrypt another chunk of n bytes.
+func (es *EncryptedStream) keyUpdateLimitReached(n int) bool {
+	config := es.config
+	switch {
+	case es.encoder.nonceExhausted():
+		return true
+	case config.KeyUpdateAfterChunks > 0 && es.keyUpdateChunks >= config.KeyUpdateAfterChunks:
+		return true
+	case config.KeyUpdateAfterBytes > 0 && es.keyUpdateBytes > 0 && es.keyUpdateBytes+uint64(n) > config.KeyUpdateAfterBytes:
+		return true
+	case config.KeyUpdateInterval > 0 && time.Since(es.keyUpdateTime) >= config.KeyUpdateInterval:
+		return true
+	case config.UsageLimitAction == UsageLimitActionKeyUpdate && es.encoder.usageLimitReached(n):
+		return true
+	default:
+		return false
+	}
+}
+
+// updateEncryptionKey sends a key update frame encrypted with the current key,
+// then switches to the next key. Should be called with write lock held.
+func (es *EncryptedStream) updateEncryptionKey(request bool) error {
+	var flags byte
+	if request {
+		flags |= keyUpdateRequested
+	}
+
+	err := es.writeFrame(frameKeyUpdate, []byte{flags})
+	if err != nil {
+		return err
+	}
+
+	return es.switchEncryptionKey(nil)
+}
+
+// switchEncryptionKey switches to the next encryption key with secret (can be
+// nil) mixed in, after a frame announcing it is written. Should be called with
+// write lock held.
+func (es *EncryptedStream) switchEncryptionKey(secret []byte) error {
+	err := es.encoder.UpdateKey(secret)
+	if err != nil {
+		return err
+	}
+
+	es.keyUpdateChunks = 0
+	es.keyUpdateBytes = 0
+	es.keyUpdateTime = time.Now()
+
+	es.rekeyLock.Lock()
+	es.rekey.encryptionKeyUpdates++
+	es.rekeyLock.Unlock()
+
+	return nil
+}
+
+// switchDecryptionKey switches to the next decryption key with secret (can be
+// nil) mixed in. Should be called with read lock held.
+func (es *EncryptedStream) switchDecryptionKey(secret []byte) error {
+	err := es.decoder.UpdateKey(secret)
+	if err != nil {
+		return err
+	}
+
+	es.rekeyLock.Lock()
+	es.rekey.decryptionKeyUpdates++
+	es.rekeyLock.Unlock()
+
+	return nil
+}
+
+// handleFrame processes the decrypted chunk in decryptBuffer when control
+// frames are enabled. Returns whether it is a data frame, in which case
+// decryptBufStart is set to the start of data. Should be called with read lock
+// held.
+func (es *EncryptedStream) handleFrame() (bool, error) {
+	if es.decryptBufEnd < frameTypeSize {
+		return false, errors.New("received empty frame")
+	}
+
+	frame := es.decryptBuffer[:es.decryptBufEnd]
+	es.decryptBufStart = es.decryptBufEnd
+
+	switch frame[0] {
+	case frameData:
+		es.decryptBufStart = frameTypeSize
+		return true, nil
+	case frameKeyUpdate:
+		return false, es.handleKeyUpdate(frame[frameTypeSize:])
+	case frameDHRekeyRequest:
+		return false, es.handleDHRekeyRequest(frame[frameTypeSize:])
+	case frameDHRekeyResponse:
+		return false, es.handleDHRekeyResponse(frame[frameTypeSize:])
+	default:
+		return false, fmt.Errorf("received unknown frame type %d", frame[0])
+	}
+}
+
+// handleKeyUpdate switches the decryption key after receiving a key update
+// frame.
+func (es *EncryptedStream) handleKeyUpdate(payload []byte) error {
+	if len(payload) != 1 {
+		return errors.New("received invalid key update frame")
+	}
+
+	var secret []byte
+	if payload[0]&keyUpdateDHRekey != 0 {
+		es.rekeyLock.Lock()
+		secret = es.rekey.receiveSecret
+		es.rekey.receiveSecret = nil
+		if secret != nil {
+			es.rekey.dhRekeys++
+			es.rekey.lastDHRekey = time.Now()
+		}
+		es.rekeyLock.Unlock()
+
+		if secret == nil {
+			return errors.New("received unexpected DH rekey key update")
+		}
+	}
+
+	err := es.switchDecryptionKey(secret)
+	if err != nil {
+		return err
+	}
+
+	if payload[0]&keyUpdateRequested != 0 {
+		es.keyUpdateRequested.Store(true)
+	}
+
+	return nil
+}
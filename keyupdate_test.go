@@ -0,0 +1,184 @@
+package stream
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func keyUpdateStreamPair(t *testing.T, cipher Cipher, config Config) (*EncryptedStream, *EncryptedStream) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceConfig := config
+	aliceConfig.Cipher = cipher
+	aliceConfig.Initiator = true
+	aliceConfig.SequentialNonce = true
+
+	bobConfig := config
+	bobConfig.Cipher = cipher
+	bobConfig.SequentialNonce = true
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, newStream(aliceConfig), newStream(bobConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return aliceEncrypted, bobEncrypted
+}
+
+func TestKeyUpdate(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var xsalsa20Key [32]byte
+	copy(xsalsa20Key[:], key)
+
+	aesgcm, err := NewAESGCMCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cipher := range []Cipher{NewXSalsa20Poly1305Cipher(&xsalsa20Key), aesgcm} {
+		aliceEncrypted, bobEncrypted := keyUpdateStreamPair(t, cipher, Config{
+			MaxChunkSize:         1024,
+			KeyUpdate:            true,
+			KeyUpdateAfterChunks: 100,
+			KeyUpdateAfterBytes:  50000,
+		})
+
+		err = readWriteTest(aliceEncrypted, bobEncrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, es := range []*EncryptedStream{aliceEncrypted, bobEncrypted} {
+			if es.encoder.cipher == cipher || es.decoder.cipher == cipher {
+				t.Fatal("key should be updated in both directions")
+			}
+		}
+	}
+}
+
+func TestKeyUpdateInterval(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted := keyUpdateStreamPair(t, cipher, Config{
+		KeyUpdate:         true,
+		KeyUpdateInterval: time.Millisecond,
+	})
+
+	data := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * time.Millisecond)
+		go write(aliceEncrypted, data)
+		err = read(bobEncrypted, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if aliceEncrypted.encoder.cipher == cipher || bobEncrypted.decoder.cipher == cipher {
+		t.Fatal("key should be updated after interval")
+	}
+}
+
+func TestKeyUpdateMaxNonce(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyUpdate := range []bool{false, true} {
+		aliceEncrypted, bobEncrypted := keyUpdateStreamPair(t, cipher, Config{KeyUpdate: keyUpdate})
+
+		// Skip to the last 3 nonces on both sides.
+		for _, nonce := range [][]byte{aliceEncrypted.encoder.nextNonce, bobEncrypted.decoder.nextNonce} {
+			copy(nonce, aliceEncrypted.encoder.maxNonce)
+			nonce[len(nonce)-1] -= 3
+		}
+
+		data := make([]byte, 100)
+		errChan := make(chan error, 1)
+		go func() {
+			for i := 0; i < 5; i++ {
+				err := write(aliceEncrypted, data)
+				if err != nil {
+					errChan <- err
+					aliceEncrypted.Close()
+					return
+				}
+			}
+			errChan <- nil
+		}()
+
+		for i := 0; i < 5; i++ {
+			err = read(bobEncrypted, data)
+			if err != nil {
+				break
+			}
+		}
+
+		err = <-errChan
+		if keyUpdate && err != nil {
+			t.Fatal(err)
+		}
+		if !keyUpdate && !errors.Is(err, ErrMaxNonce) {
+			t.Fatalf("expect ErrMaxNonce, got %v", err)
+		}
+	}
+}
+
+func TestKeyUpdateHandshake(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{KeyUpdate: true, KeyUpdateAfterBytes: 1 << 18}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, Config: config}),
+		handshake(HandshakeConfig{Config: config}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parameterMismatchTest(
+		t,
+		handshake(HandshakeConfig{Initiator: true, Config: config}),
+		handshake(HandshakeConfig{}),
+		"KeyUpdate",
+	)
+}
+
+func TestKeyUpdateNotSupported(t *testing.T) {
+	aead, err := chacha20poly1305.New(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewEncryptedStream(nil, &Config{Cipher: NewCryptoAEADCipher(aead), KeyUpdate: true})
+	if err != ErrKeyUpdateNotSupported {
+		t.Fatalf("expect ErrKeyUpdateNotSupported, got %v", err)
+	}
+}
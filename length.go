@@ -0,0 +1,141 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	// lengthKeyInfo is the HKDF info used to derive the length key from the
+	// session keys of a handshake.
+	lengthKeyInfo = "encrypted-stream length key"
+
+	// maxLengthCipherChunks is the max number of length prefixes encrypted in
+	// one direction, beyond which the ChaCha20 block counter would overflow.
+	maxLengthCipherChunks = 1 << 36
+)
+
+// ErrMaxLengthChunks indicates the max number of chunks whose length can be
+// encrypted with the length key is reached. A new stream with a different
+// length key should be created.
+var ErrMaxLengthChunks = errors.New("max number of encrypted lengths reached")
+
+// lengthCipher encrypts or decrypts the length prefix of chunks in one
+// direction with ChaCha20 keystream, similar to the header key of OpenSSH
+// chacha20-poly1305. Each length consumes the next 4 bytes of keystream, so the
+// two sides stay in sync as long as chunks are delivered in order. Two
+// directions use different fixed nonces with the same key, so the key should
+// be unique per stream, as the ones derived by handshakes are.
+type lengthCipher struct {
+	stream *chacha20.Cipher
+	chunks uint64
+}
+
+// newLengthCipher creates a lengthCipher for the direction whose sender is
+// initiator or not.
+func newLengthCipher(key []byte, initiator bool) (*lengthCipher, error) {
+	nonce := make([]byte, chacha20.NonceSize)
+	if !initiator {
+		nonce[0] = 1
+	}
+
+	stream, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lengthCipher{stream: stream}, nil
+}
+
+// destroy overwrites the key and keystream state. lengthCipher should not be
+// used afterwards.
+func (c *lengthCipher) destroy() {
+	*c.stream = chacha20.Cipher{}
+}
+
+// xor encrypts or decrypts a length prefix in place.
+func (c *lengthCipher) xor(b []byte) error {
+	if c.chunks >= maxLengthCipherChunks {
+		return ErrMaxLengthChunks
+	}
+
+	c.stream.XORKeyStream(b[:lengthPrefixSize], b[:lengthPrefixSize])
+	c.chunks++
+
+	return nil
+}
+
+// deriveLengthKey derives the length key shared by both directions from the
+// session keys of a handshake, so that it is unique per stream. Salt (e.g.
+// Config.LengthKey) is optional.
+func deriveLengthKey(keys *sessionKeys, initiator bool, salt []byte) ([]byte, error) {
+	initiatorKey, responderKey := keys.encryptKey, keys.decryptKey
+	if !initiator {
+		initiatorKey, responderKey = responderKey, initiatorKey
+	}
+
+	secret := make([]byte, 0, len(initiatorKey)+len(responderKey))
+	secret = append(secret, initiatorKey...)
+	secret = append(secret, responderKey...)
+	defer erase(secret)
+
+	return deriveSecret(secret, salt, lengthKeyInfo)
+}
+
+// readChunk reads an encrypted chunk into read buffer and returns its size.
+// The length prefix is decrypted first if it is encrypted, and a chunk larger
+// than read buffer is rejected before reading its body. The decrypted length is
+// not trusted until the chunk is decrypted, which authenticates it.
+func (es *EncryptedStream) readChunk() (int, error) {
+	if es.readLengthCipher == nil {
+		return readVarBytes(es.reader, es.readBuffer, es.readLenBuffer)
+	}
+
+	_, err := io.ReadFull(es.reader, es.readLenBuffer)
+	if err != nil {
+		return 0, err
+	}
+
+	err = es.readLengthCipher.xor(es.readLenBuffer)
+	if err != nil {
+		return 0, err
+	}
+
+	n := binary.LittleEndian.Uint32(es.readLenBuffer)
+	if uint64(n) > uint64(len(es.readBuffer)) {
+		return 0, fmt.Errorf("received invalid encrypted data size %d", n)
+	}
+
+	return io.ReadFull(es.reader, es.readBuffer[:n])
+}
+
+// writeChunk writes an encrypted chunk with its length prefix, which is
+// encrypted if Config.EncryptLength is true.
+func (es *EncryptedStream) writeChunk(b []byte) error {
+	if es.writeLengthCipher == nil {
+		return writeVarBytes(es.stream, b, es.writeLenBuffer)
+	}
+
+	binary.LittleEndian.PutUint32(es.writeLenBuffer, uint32(len(b)))
+
+	err := es.writeLengthCipher.xor(es.writeLenBuffer)
+	if err != nil {
+		return err
+	}
+
+	_, err = es.stream.Write(es.writeLenBuffer)
+	if err != nil {
+		return err
+	}
+
+	_, err = es.stream.Write(b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+func TestEncryptLength(t *testing.T) {
+	// Capture data sent by alice.
+	captured := &bytes.Buffer{}
+	aliceReader, bobWriter := io.Pipe()
+	bobReader, aliceWriter := io.Pipe()
+	alice := &readWriteCloser{Reader: aliceReader, Writer: io.MultiWriter(captured, aliceWriter), Closer: aliceWriter}
+	bob := &readWriteCloser{Reader: bobReader, Writer: bobWriter, Closer: bobWriter}
+
+	config := &Config{EncryptLength: true}
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, Config: config}),
+		handshake(HandshakeConfig{Config: config}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := captured.Len()
+	send(t, aliceEncrypted, bobEncrypted, []byte("hello"), nil)
+
+	chunk := captured.Bytes()[offset:]
+	if binary.LittleEndian.Uint32(chunk[:lengthPrefixSize]) == uint32(len(chunk)-lengthPrefixSize) {
+		t.Fatal("chunk length should be encrypted")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptLengthOversize(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lengthKey := bytes.Repeat([]byte{1}, 32)
+
+	_, err = NewEncryptedStream(nil, &Config{Cipher: cipher, EncryptLength: true})
+	if err == nil {
+		t.Fatal("EncryptLength should require LengthKey")
+	}
+
+	lengthCipher, err := newLengthCipher(lengthKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lenBuf := make([]byte, lengthPrefixSize)
+	binary.LittleEndian.PutUint32(lenBuf, 1<<30)
+	err = lengthCipher.xor(lenBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the length prefix is available, so reading the body would fail
+	// with io.ErrUnexpectedEOF.
+	r := &readWriteCloser{Reader: bytes.NewReader(lenBuf)}
+	es, err := NewEncryptedStream(r, &Config{Cipher: cipher, EncryptLength: true, LengthKey: lengthKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = es.Read(make([]byte, 1024))
+	if err == nil || !strings.Contains(err.Error(), "invalid encrypted data size") {
+		t.Fatalf("expect oversize frame to be rejected, got %v", err)
+	}
+}
+
+func TestEncryptLengthParameterMismatch(t *testing.T) {
+	parameterMismatchTest(
+		t,
+		handshake(HandshakeConfig{Initiator: true, Config: &Config{EncryptLength: true}}),
+		handshake(HandshakeConfig{}),
+		"EncryptLength",
+	)
+}
+
+func TestEncryptLengthClose(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{EncryptLength: true}
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, Config: config}),
+		handshake(HandshakeConfig{Config: config}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bobEncrypted.Close()
+
+	lengthKey := aliceEncrypted.config.LengthKey
+	writeStream := aliceEncrypted.writeLengthCipher.stream
+	readStream := aliceEncrypted.readLengthCipher.stream
+
+	err = aliceEncrypted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(lengthKey, make([]byte, len(lengthKey))) {
+		t.Fatal("length key should be erased")
+	}
+
+	if *writeStream != (chacha20.Cipher{}) || *readStream != (chacha20.Cipher{}) {
+		t.Fatal("length cipher state should be erased")
+	}
+}
@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// masterKeyProtocolName identifies the master key protocol and is the first
+	// thing mixed into handshake transcript.
+	masterKeyProtocolName = "EncryptedStream_MasterKey_SHA256"
+
+	// masterKeySessionKeysInfo is the HKDF info used to derive session keys
+	// from master key.
+	masterKeySessionKeysInfo = "encrypted-stream master key session keys"
+
+	// masterKeySaltSize is the size of random salt sent by each side.
+	masterKeySaltSize = 32
+
+	// minMasterKeySize is the min size of master key.
+	minMasterKeySize = 16
+)
+
+// MasterKeyConfig is the configuration for NewMasterKeyStream.
+type MasterKeyConfig struct {
+	// Initiator indicates the direction of the stream (initiator or responder).
+	// Two sides of the stream should set this to different value.
+	Initiator bool
+
+	// MasterKey is the long-term key shared by both sides. It can be used by
+	// any number of streams. It should have high entropy (e.g. 32 random
+	// bytes); use PAKEHandshake for passwords.
+	MasterKey []byte
+
+	// CipherSuite is the cipher suite of the created stream. Both sides should
+	// use the same value, otherwise *ParameterMismatchError is returned. Default
+	// is CipherSuiteChaCha20Poly1305.
+	CipherSuite CipherSuite
+
+	// Config is the config of the encrypted stream. It will be merged with the
+	// default config. Cipher, Initiator and SequentialNonce will be set by
+	// NewMasterKeyStream and should be left empty.
+	Config *Config
+}
+
+// NewMasterKeyStream creates an EncryptedStream from a long-term master key
+// shared by many streams. Each side sends a random salt over the stream, and
+// a separate send and receive key is derived from master key and both salts
+// using HKDF. Because keys are unique for every stream and every direction,
+// sequential nonce is always enabled and safe, unlike using master key
+// directly with NewEncryptedStream. Note that it does not provide forward
+// secrecy: if the master key is compromised, all streams using it can be
+// decrypted. A wrong master key is not detected until the first chunk fails to
+// decrypt; use PSKHandshake if key confirmation is needed.
+func NewMasterKeyStream(conn io.ReadWriter, config *MasterKeyConfig) (*EncryptedStream, error) {
+	if config == nil {
+		return nil, errors.New("nil master key config")
+	}
+
+	if len(config.MasterKey) < minMasterKeySize {
+		return nil, fmt.Errorf("master key should be at least %d bytes", minMasterKeySize)
+	}
+
+	suite := config.CipherSuite
+	if suite == 0 {
+		suite = CipherSuiteChaCha20Poly1305
+	}
+
+	salt := make([]byte, masterKeySaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := newStreamParameters(config.Config, suite)
+	if err != nil {
+		return nil, err
+	}
+	localParams := params.marshal()
+
+	var peerSalt, peerParams []byte
+	if config.Initiator {
+		err = writeHandshakeMessage(conn, salt, localParams)
+		if err != nil {
+			return nil, err
+		}
+
+		peerSalt, peerParams, err = readMasterKeySalt(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		err = params.check(peerParams)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		peerSalt, peerParams, err = readMasterKeySalt(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		// Reply with local parameters on mismatch so that initiator gets the
+		// same error.
+		mismatch := params.check(peerParams)
+
+		err = writeHandshakeMessage(conn, salt, localParams)
+		if err != nil {
+			return nil, err
+		}
+
+		if mismatch != nil {
+			return nil, mismatch
+		}
+	}
+
+	t := newTranscript(masterKeyProtocolName)
+	if config.Initiator {
+		t.add(salt, peerSalt, localParams, peerParams)
+	} else {
+		t.add(peerSalt, salt, peerParams, localParams)
+	}
+	th := t.sum()
+
+	keys, err := deriveDirectionalKeys(config.MasterKey, th, masterKeySessionKeysInfo, config.Initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := newHandshakeStream(conn, config.Config, config.Initiator, suite, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = es.setExporter(config.MasterKey, th)
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+// readMasterKeySalt reads the random salt and stream parameters sent by the
+// other side.
+func readMasterKeySalt(conn io.Reader) ([]byte, []byte, error) {
+	fields, err := readHandshakeMessage(conn, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(fields[0]) != masterKeySaltSize {
+		return nil, nil, errors.New("invalid master key salt")
+	}
+
+	return fields[0], fields[1], nil
+}
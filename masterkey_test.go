@@ -0,0 +1,122 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func masterKeyHandshake(config MasterKeyConfig) handshakeFunc {
+	return func(conn io.ReadWriter) (*EncryptedStream, error) {
+		return NewMasterKeyStream(conn, &config)
+	}
+}
+
+func TestMasterKeyStream(t *testing.T) {
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, suite := range DefaultCipherSuites() {
+		t.Run(suite.String(), func(t *testing.T) {
+			alice, bob, err := createPipe(false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			aliceEncrypted, bobEncrypted, err := handshakePair(
+				alice,
+				bob,
+				masterKeyHandshake(MasterKeyConfig{Initiator: true, MasterKey: masterKey, CipherSuite: suite}),
+				masterKeyHandshake(MasterKeyConfig{MasterKey: masterKey, CipherSuite: suite}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if aliceEncrypted.CipherSuite() != suite {
+				t.Fatalf("expect cipher suite %v, got %v", suite, aliceEncrypted.CipherSuite())
+			}
+
+			err = readWriteTest(aliceEncrypted, bobEncrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMasterKeyStreamUniqueKeys(t *testing.T) {
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ekm [][]byte
+	for i := 0; i < 2; i++ {
+		alice, bob, err := createPipe(false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aliceEncrypted, _, err := handshakePair(
+			alice,
+			bob,
+			masterKeyHandshake(MasterKeyConfig{Initiator: true, MasterKey: masterKey}),
+			masterKeyHandshake(MasterKeyConfig{MasterKey: masterKey}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := aliceEncrypted.ExportKeyingMaterial("test", nil, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ekm = append(ekm, b)
+	}
+
+	if bytes.Equal(ekm[0], ekm[1]) {
+		t.Fatal("streams with the same master key should have different keys")
+	}
+}
+
+func TestMasterKeyStreamWrongKey(t *testing.T) {
+	aliceKey := make([]byte, 32)
+	_, err := rand.Read(aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey := make([]byte, 32)
+	_, err = rand.Read(bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		masterKeyHandshake(MasterKeyConfig{Initiator: true, MasterKey: aliceKey}),
+		masterKeyHandshake(MasterKeyConfig{MasterKey: bobKey}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go aliceEncrypted.Write([]byte("hello"))
+
+	_, err = bobEncrypted.Read(make([]byte, 5))
+	if err == nil {
+		t.Fatal("read with wrong master key should fail")
+	}
+}
@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+)
+
+// nknPrologue is the Noise prologue of NKNHandshake, which separates it from
+// other Noise KK handshakes using the same static keys.
+const nknPrologue = "encrypted-stream NKN"
+
+// NKNConfig is the configuration for NKNHandshake.
+type NKNConfig struct {
+	// Initiator indicates the direction of the handshake (initiator or
+	// responder). Two sides of the handshake should set this to different value.
+	Initiator bool
+
+	// PrivateKey is the local NKN Ed25519 private key, which can be created
+	// from NKN seed by ed25519.NewKeyFromSeed.
+	PrivateKey ed25519.PrivateKey
+
+	// RemotePublicKey is the peer's NKN Ed25519 public key, e.g. the public key
+	// part of its NKN address.
+	RemotePublicKey ed25519.PublicKey
+
+	// Config is the config of the encrypted stream created after handshake. It
+	// will be merged with the default config. Cipher, Initiator and
+	// SequentialNonce will be set by handshake and should be left empty.
+	Config *Config
+}
+
+// Ed25519PrivateKeyToCurve25519 converts an Ed25519 private key to the
+// Curve25519 private key with the same scalar, in the same way as NKN.
+func Ed25519PrivateKeyToCurve25519(privateKey ed25519.PrivateKey) ([]byte, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("private key should be %d bytes", ed25519.PrivateKeySize)
+	}
+
+	h := sha512.Sum512(privateKey.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+
+	return h[:32], nil
+}
+
+// Ed25519PublicKeyToCurve25519 converts an Ed25519 public key to the
+// Curve25519 public key of the same point, in the same way as NKN.
+func Ed25519PublicKeyToCurve25519(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key should be %d bytes", ed25519.PublicKeySize)
+	}
+
+	p, err := new(edwards25519.Point).SetBytes(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.BytesMontgomery(), nil
+}
+
+// NKNHandshake performs a mutually authenticated handshake using NKN Ed25519
+// keys, so that two NKN clients only need each other's NKN public key. Both
+// Ed25519 keys are converted to Curve25519, then a Noise KK handshake is
+// performed, which combines static-static, static-ephemeral and
+// ephemeral-ephemeral key agreement. The peer's NKN public key is available
+// through PeerPublicKey of the created stream.
+func NKNHandshake(conn io.ReadWriter, config *NKNConfig) (*EncryptedStream, error) {
+	if config == nil {
+		return nil, errors.New("nil nkn config")
+	}
+
+	staticPrivateKey, err := Ed25519PrivateKeyToCurve25519(config.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteStaticKey, err := Ed25519PublicKeyToCurve25519(config.RemotePublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := NoiseHandshake(conn, &NoiseConfig{
+		Pattern:          NoiseKK,
+		Initiator:        config.Initiator,
+		StaticPrivateKey: staticPrivateKey,
+		RemoteStaticKey:  remoteStaticKey,
+		Prologue:         []byte(nknPrologue),
+		Config:           config.Config,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	es.peerPublicKey = config.RemotePublicKey
+
+	return es, nil
+}
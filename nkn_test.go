@@ -0,0 +1,110 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func nknHandshake(config NKNConfig) handshakeFunc {
+	return func(conn io.ReadWriter) (*EncryptedStream, error) {
+		return NKNHandshake(conn, &config)
+	}
+}
+
+func TestEd25519ToCurve25519(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		curvePrivateKey, err := Ed25519PrivateKeyToCurve25519(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		curvePublicKey, err := Ed25519PublicKeyToCurve25519(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := curve25519.X25519(curvePrivateKey, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(curvePublicKey, expected) {
+			t.Fatal("converted public key does not match converted private key")
+		}
+	}
+}
+
+func TestNKNHandshake(t *testing.T) {
+	alicePub, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPub, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		nknHandshake(NKNConfig{Initiator: true, PrivateKey: aliceKey, RemotePublicKey: bobPub}),
+		nknHandshake(NKNConfig{PrivateKey: bobKey, RemotePublicKey: alicePub}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(aliceEncrypted.PeerPublicKey(), bobPub) || !bytes.Equal(bobEncrypted.PeerPublicKey(), alicePub) {
+		t.Fatal("wrong peer public key")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNKNHandshakeWrongRemoteKey(t *testing.T) {
+	_, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPub, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := net.Pipe()
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		nknHandshake(NKNConfig{Initiator: true, PrivateKey: aliceKey, RemotePublicKey: bobPub}),
+		nknHandshake(NKNConfig{PrivateKey: bobKey, RemotePublicKey: evePub}),
+	)
+	if err == nil {
+		t.Fatal("handshake with wrong remote public key should fail")
+	}
+}
@@ -0,0 +1,636 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	noiseDHLen   = 32
+	noiseHashLen = blake2b.Size
+	noiseKeyLen  = chacha20poly1305.KeySize
+
+	// maxNoiseMessageSize is the max size of a Noise message defined by Noise
+	// specification.
+	maxNoiseMessageSize = 65535
+)
+
+// NoisePattern is a Noise handshake pattern.
+type NoisePattern int
+
+const (
+	// NoiseXX is the Noise XX pattern. Both sides transmit their static keys
+	// during handshake, so no prior knowledge of peer's static key is needed.
+	NoiseXX NoisePattern = iota
+
+	// NoiseIK is the Noise IK pattern. Initiator should know responder's static
+	// key before handshake (NoiseConfig.RemoteStaticKey), and can send early data
+	// in its first handshake message (NoiseConfig.EarlyData), saving one round
+	// trip compared to NoiseXX.
+	NoiseIK
+
+	// NoiseKK is the Noise KK pattern. Both sides should know each other's
+	// static key before handshake (NoiseConfig.RemoteStaticKey), so static keys
+	// are not transmitted during handshake.
+	NoiseKK
+)
+
+// ErrEarlyDataRejected indicates the initiator sent early data but responder
+// does not accept it (NoiseConfig.AcceptEarlyData is false).
+var ErrEarlyDataRejected = errors.New("early data rejected")
+
+// NoiseConfig is the configuration for NoiseHandshake.
+type NoiseConfig struct {
+	// Pattern is the Noise handshake pattern. Both sides should use the same
+	// pattern. Default is NoiseXX.
+	Pattern NoisePattern
+
+	// Initiator indicates the direction of the handshake (initiator or
+	// responder). Two sides of the handshake should set this to different value.
+	Initiator bool
+
+	// StaticPrivateKey is the 32 bytes Curve25519 private key that identifies
+	// the local side. It can be generated by GenerateStaticKey.
+	StaticPrivateKey []byte
+
+	// RemoteStaticKey is the peer's 32 bytes Curve25519 static public key known
+	// before handshake. It is required by initiator when using NoiseIK, by both
+	// sides when using NoiseKK, and ignored otherwise.
+	RemoteStaticKey []byte
+
+	// VerifyPeerStaticKey, if not nil, is called with peer's static public key
+	// as soon as it is received during handshake. Returning a non-nil error will
+	// abort the handshake. If nil, any peer static key will be accepted, and
+	// application should check PeerStaticKey() of the created stream instead.
+	VerifyPeerStaticKey func(peerStaticKey []byte) error
+
+	// Prologue is optional data that both sides should agree on. It is
+	// authenticated by the handshake, and handshake fails if it's different.
+	Prologue []byte
+
+	// EarlyData is application data that initiator sends in its first handshake
+	// message (0-RTT data). It is only supported by NoiseIK, and responder needs
+	// to set AcceptEarlyData to true to accept it. Responder can read it from
+	// the created stream using Read just like any other data.
+	//
+	// IMPORTANT: Early data does not have the same security properties as data
+	// sent after handshake. It can be replayed by an attacker to responder, as
+	// responder has not contributed any randomness when receiving it, and it
+	// will be revealed if responder's static private key is compromised.
+	// Only send early data that is idempotent and not very sensitive.
+	EarlyData []byte
+
+	// AcceptEarlyData indicates whether responder accepts early data sent by
+	// initiator. If false, handshake with early data will fail with
+	// ErrEarlyDataRejected. See EarlyData for its replay caveats.
+	AcceptEarlyData bool
+
+	// Config is the config of the encrypted stream created after handshake. It
+	// will be merged with the default config. Cipher, Initiator and
+	// SequentialNonce will be set by handshake and should be left empty.
+	Config *Config
+}
+
+// GenerateStaticKey generates a random Curve25519 static key pair that can be
+// used as NoiseConfig.StaticPrivateKey.
+func GenerateStaticKey() (privateKey, publicKey []byte, err error) {
+	return generateX25519Key()
+}
+
+// NoiseHandshake performs a Noise handshake (Noise_XX_25519_ChaChaPoly_BLAKE2b
+// by default) over the given ReadWriter, and creates an EncryptedStream from
+// the resulting cipher states. The authenticated peer static key is available
+// through PeerStaticKey of the created stream.
+func NoiseHandshake(conn io.ReadWriter, config *NoiseConfig) (*EncryptedStream, error) {
+	if config == nil {
+		return nil, errors.New("nil noise config")
+	}
+
+	hs, err := newNoiseHandshakeState(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.EarlyData) > 0 && (!config.Initiator || config.Pattern != NoiseIK) {
+		return nil, errors.New("early data can only be sent by initiator using NoiseIK")
+	}
+
+	params, err := newStreamParameters(config.Config, CipherSuiteChaCha20Poly1305)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first message in each direction carries stream parameters in its
+	// payload, followed by early data in the first message of NoiseIK.
+	var earlyData []byte
+	var mismatch error
+	buf := make([]byte, maxNoiseMessageSize)
+	for !hs.finished() {
+		if hs.isWriteTurn() {
+			var payload []byte
+			var err error
+			switch {
+			case hs.messageIndex == 0 && len(config.EarlyData) > 0:
+				payload, err = marshalFields(params.marshal(), config.EarlyData)
+			case hs.messageIndex <= 1:
+				payload, err = marshalFields(params.marshal())
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			msg, err := hs.writeMessage(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			err = writeVarBytes(conn, msg, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			// Responder returns parameter mismatch error after sending its
+			// parameters so that initiator gets the same error.
+			if mismatch != nil {
+				return nil, mismatch
+			}
+		} else {
+			n, err := readVarBytes(conn, buf, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			payload, err := hs.readMessage(buf[:n])
+			if err != nil {
+				return nil, err
+			}
+
+			if hs.messageIndex > 2 {
+				if len(payload) > 0 {
+					return nil, errors.New("unexpected noise handshake payload")
+				}
+				continue
+			}
+
+			fields, err := unmarshalFields(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(fields) == 0 || (hs.messageIndex == 2 && len(fields) > 1) {
+				return nil, errors.New("invalid noise handshake payload")
+			}
+
+			if len(fields) > 1 {
+				if config.Pattern != NoiseIK || len(fields) > 2 {
+					return nil, errors.New("unexpected noise handshake payload")
+				}
+				if !config.AcceptEarlyData {
+					return nil, ErrEarlyDataRejected
+				}
+				earlyData = fields[1]
+			}
+
+			mismatch = params.check(fields[0])
+			if mismatch != nil && config.Initiator {
+				return nil, mismatch
+			}
+		}
+	}
+
+	initiatorKey, responderKey := hs.ss.split()
+
+	keys := &sessionKeys{encryptKey: initiatorKey, decryptKey: responderKey}
+	if !config.Initiator {
+		keys = &sessionKeys{encryptKey: responderKey, decryptKey: initiatorKey}
+	}
+
+	es, err := newHandshakeStream(conn, config.Config, config.Initiator, CipherSuiteChaCha20Poly1305, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = es.setExporter(hs.ss.ck, hs.ss.h)
+	if err != nil {
+		return nil, err
+	}
+
+	es.peerStaticKey = hs.rs
+	es.earlyData = earlyData
+
+	return es, nil
+}
+
+// noiseToken is a token in Noise message pattern.
+type noiseToken int
+
+const (
+	noiseTokenE noiseToken = iota
+	noiseTokenS
+	noiseTokenEE
+	noiseTokenES
+	noiseTokenSE
+	noiseTokenSS
+)
+
+// noisePatternDef is the definition of a Noise handshake pattern.
+type noisePatternDef struct {
+	name string
+
+	// initiatorPreMessage and responderPreMessage indicate whether the static key
+	// of initiator or responder is known by peer before handshake.
+	initiatorPreMessage bool
+	responderPreMessage bool
+
+	messages [][]noiseToken
+}
+
+var noisePatterns = map[NoisePattern]*noisePatternDef{
+	NoiseXX: {
+		name: "XX",
+		messages: [][]noiseToken{
+			{noiseTokenE},
+			{noiseTokenE, noiseTokenEE, noiseTokenS, noiseTokenES},
+			{noiseTokenS, noiseTokenSE},
+		},
+	},
+	NoiseIK: {
+		name:                "IK",
+		responderPreMessage: true,
+		messages: [][]noiseToken{
+			{noiseTokenE, noiseTokenES, noiseTokenS, noiseTokenSS},
+			{noiseTokenE, noiseTokenEE, noiseTokenSE},
+		},
+	},
+	NoiseKK: {
+		name:                "KK",
+		initiatorPreMessage: true,
+		responderPreMessage: true,
+		messages: [][]noiseToken{
+			{noiseTokenE, noiseTokenES, noiseTokenSS},
+			{noiseTokenE, noiseTokenEE, noiseTokenSE},
+		},
+	},
+}
+
+// noiseCipherState is the CipherState object in Noise specification.
+type noiseCipherState struct {
+	key    []byte
+	nonce  uint64
+	hasKey bool
+}
+
+func (cs *noiseCipherState) initializeKey(key []byte) {
+	cs.key = key
+	cs.nonce = 0
+	cs.hasKey = true
+}
+
+func (cs *noiseCipherState) aeadNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	return nonce
+}
+
+func (cs *noiseCipherState) encryptWithAd(ad, plaintext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return plaintext, nil
+	}
+
+	if cs.nonce == math.MaxUint64 {
+		return nil, ErrMaxNonce
+	}
+
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := aead.Seal(nil, cs.aeadNonce(), plaintext, ad)
+	cs.nonce++
+
+	return ciphertext, nil
+}
+
+func (cs *noiseCipherState) decryptWithAd(ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return ciphertext, nil
+	}
+
+	if cs.nonce == math.MaxUint64 {
+		return nil, ErrMaxNonce
+	}
+
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, cs.aeadNonce(), ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt failed: %v", err)
+	}
+	cs.nonce++
+
+	return plaintext, nil
+}
+
+// noiseSymmetricState is the SymmetricState object in Noise specification.
+type noiseSymmetricState struct {
+	cs noiseCipherState
+	ck []byte
+	h  []byte
+}
+
+func newNoiseHash() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+func (ss *noiseSymmetricState) initializeSymmetric(protocolName string) {
+	if len(protocolName) <= noiseHashLen {
+		ss.h = make([]byte, noiseHashLen)
+		copy(ss.h, protocolName)
+	} else {
+		h := newNoiseHash()
+		h.Write([]byte(protocolName))
+		ss.h = h.Sum(nil)
+	}
+	ss.ck = append([]byte(nil), ss.h...)
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) {
+	outputs := noiseHKDF(ss.ck, ikm, 2)
+	ss.ck = outputs[0]
+	ss.cs.initializeKey(outputs[1][:noiseKeyLen])
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	h := newNoiseHash()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := ss.cs.encryptWithAd(ss.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decryptWithAd(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the initiator to responder key and the responder to initiator
+// key.
+func (ss *noiseSymmetricState) split() ([]byte, []byte) {
+	outputs := noiseHKDF(ss.ck, nil, 2)
+	return outputs[0][:noiseKeyLen], outputs[1][:noiseKeyLen]
+}
+
+// noiseHKDF is the HKDF function in Noise specification using HMAC-BLAKE2b.
+func noiseHKDF(chainingKey, ikm []byte, numOutputs int) [][]byte {
+	mac := hmac.New(newNoiseHash, chainingKey)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	outputs := make([][]byte, 0, numOutputs)
+	var prev []byte
+	for i := 1; i <= numOutputs; i++ {
+		mac = hmac.New(newNoiseHash, tempKey)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i)})
+		prev = mac.Sum(nil)
+		outputs = append(outputs, prev)
+	}
+
+	return outputs
+}
+
+// noiseHandshakeState is the HandshakeState object in Noise specification.
+type noiseHandshakeState struct {
+	ss        noiseSymmetricState
+	pattern   *noisePatternDef
+	initiator bool
+
+	s, sPub []byte
+	e, ePub []byte
+	rs, re  []byte
+
+	verifyPeerStaticKey func([]byte) error
+	messageIndex        int
+}
+
+func newNoiseHandshakeState(config *NoiseConfig) (*noiseHandshakeState, error) {
+	pattern, ok := noisePatterns[config.Pattern]
+	if !ok {
+		return nil, fmt.Errorf("unknown noise pattern %v", config.Pattern)
+	}
+
+	if len(config.StaticPrivateKey) != noiseDHLen {
+		return nil, fmt.Errorf("static private key should be %d bytes", noiseDHLen)
+	}
+
+	sPub, err := curve25519.X25519(config.StaticPrivateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &noiseHandshakeState{
+		pattern:             pattern,
+		initiator:           config.Initiator,
+		s:                   config.StaticPrivateKey,
+		sPub:                sPub,
+		verifyPeerStaticKey: config.VerifyPeerStaticKey,
+	}
+
+	if (pattern.initiatorPreMessage && !config.Initiator) || (pattern.responderPreMessage && config.Initiator) {
+		if len(config.RemoteStaticKey) != noiseDHLen {
+			return nil, fmt.Errorf("remote static key should be %d bytes", noiseDHLen)
+		}
+		hs.rs = config.RemoteStaticKey
+	}
+
+	hs.ss.initializeSymmetric("Noise_" + pattern.name + "_25519_ChaChaPoly_BLAKE2b")
+	hs.ss.mixHash(config.Prologue)
+
+	if pattern.initiatorPreMessage {
+		if config.Initiator {
+			hs.ss.mixHash(hs.sPub)
+		} else {
+			hs.ss.mixHash(hs.rs)
+		}
+	}
+
+	if pattern.responderPreMessage {
+		if config.Initiator {
+			hs.ss.mixHash(hs.rs)
+		} else {
+			hs.ss.mixHash(hs.sPub)
+		}
+	}
+
+	return hs, nil
+}
+
+func (hs *noiseHandshakeState) finished() bool {
+	return hs.messageIndex >= len(hs.pattern.messages)
+}
+
+func (hs *noiseHandshakeState) isWriteTurn() bool {
+	return (hs.messageIndex%2 == 0) == hs.initiator
+}
+
+func (hs *noiseHandshakeState) mixDH(token noiseToken) error {
+	var privateKey, publicKey []byte
+	switch token {
+	case noiseTokenEE:
+		privateKey, publicKey = hs.e, hs.re
+	case noiseTokenES:
+		if hs.initiator {
+			privateKey, publicKey = hs.e, hs.rs
+		} else {
+			privateKey, publicKey = hs.s, hs.re
+		}
+	case noiseTokenSE:
+		if hs.initiator {
+			privateKey, publicKey = hs.s, hs.re
+		} else {
+			privateKey, publicKey = hs.e, hs.rs
+		}
+	case noiseTokenSS:
+		privateKey, publicKey = hs.s, hs.rs
+	default:
+		return fmt.Errorf("unknown noise token %v", token)
+	}
+
+	if privateKey == nil || publicKey == nil {
+		return errors.New("noise key is not available")
+	}
+
+	sharedSecret, err := curve25519.X25519(privateKey, publicKey)
+	if err != nil {
+		return err
+	}
+
+	hs.ss.mixKey(sharedSecret)
+
+	return nil
+}
+
+// writeMessage writes the next handshake message with the given payload.
+func (hs *noiseHandshakeState) writeMessage(payload []byte) ([]byte, error) {
+	if hs.finished() || !hs.isWriteTurn() {
+		return nil, errors.New("not noise handshake write turn")
+	}
+
+	var msg []byte
+	for _, token := range hs.pattern.messages[hs.messageIndex] {
+		switch token {
+		case noiseTokenE:
+			e, ePub, err := generateX25519Key()
+			if err != nil {
+				return nil, err
+			}
+			hs.e, hs.ePub = e, ePub
+			msg = append(msg, ePub...)
+			hs.ss.mixHash(ePub)
+		case noiseTokenS:
+			encrypted, err := hs.ss.encryptAndHash(hs.sPub)
+			if err != nil {
+				return nil, err
+			}
+			msg = append(msg, encrypted...)
+		default:
+			err := hs.mixDH(token)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	encrypted, err := hs.ss.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, encrypted...)
+
+	if len(msg) > maxNoiseMessageSize {
+		return nil, errors.New("noise message too large")
+	}
+
+	hs.messageIndex++
+
+	return msg, nil
+}
+
+// readMessage reads the next handshake message and returns its payload.
+func (hs *noiseHandshakeState) readMessage(msg []byte) ([]byte, error) {
+	if hs.finished() || hs.isWriteTurn() {
+		return nil, errors.New("not noise handshake read turn")
+	}
+
+	for _, token := range hs.pattern.messages[hs.messageIndex] {
+		switch token {
+		case noiseTokenE:
+			if len(msg) < noiseDHLen {
+				return nil, errors.New("noise message too short")
+			}
+			hs.re = append([]byte(nil), msg[:noiseDHLen]...)
+			msg = msg[noiseDHLen:]
+			hs.ss.mixHash(hs.re)
+		case noiseTokenS:
+			size := noiseDHLen
+			if hs.ss.cs.hasKey {
+				size += chacha20poly1305.Overhead
+			}
+			if len(msg) < size {
+				return nil, errors.New("noise message too short")
+			}
+			rs, err := hs.ss.decryptAndHash(msg[:size])
+			if err != nil {
+				return nil, err
+			}
+			msg = msg[size:]
+			hs.rs = rs
+			if hs.verifyPeerStaticKey != nil {
+				err = hs.verifyPeerStaticKey(rs)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			err := hs.mixDH(token)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err := hs.ss.decryptAndHash(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.messageIndex++
+
+	return payload, nil
+}
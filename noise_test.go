@@ -0,0 +1,254 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func noiseHandshake(config NoiseConfig) handshakeFunc {
+	return func(conn io.ReadWriter) (*EncryptedStream, error) {
+		return NoiseHandshake(conn, &config)
+	}
+}
+
+func TestNoiseXX(t *testing.T) {
+	aliceKey, alicePub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, bobPub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		noiseHandshake(NoiseConfig{Initiator: true, StaticPrivateKey: aliceKey}),
+		noiseHandshake(NoiseConfig{StaticPrivateKey: bobKey}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(aliceEncrypted.PeerStaticKey(), bobPub) {
+		t.Fatal("alice got wrong peer static key")
+	}
+
+	if !bytes.Equal(bobEncrypted.PeerStaticKey(), alicePub) {
+		t.Fatal("bob got wrong peer static key")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoiseXXRejectPeer(t *testing.T) {
+	aliceKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errRejected := errors.New("rejected")
+
+	alice, bob := net.Pipe()
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		noiseHandshake(NoiseConfig{Initiator: true, StaticPrivateKey: aliceKey}),
+		noiseHandshake(NoiseConfig{
+			StaticPrivateKey: bobKey,
+			VerifyPeerStaticKey: func([]byte) error {
+				return errRejected
+			},
+		}),
+	)
+	if err != errRejected {
+		t.Fatalf("expect error %v, got %v", errRejected, err)
+	}
+}
+
+func TestNoiseXXPrologueMismatch(t *testing.T) {
+	aliceKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := net.Pipe()
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		noiseHandshake(NoiseConfig{Initiator: true, StaticPrivateKey: aliceKey, Prologue: []byte("a")}),
+		noiseHandshake(NoiseConfig{StaticPrivateKey: bobKey, Prologue: []byte("b")}),
+	)
+	if err == nil {
+		t.Fatal("handshake with different prologue should fail")
+	}
+}
+
+func TestNoiseIKEarlyData(t *testing.T) {
+	aliceKey, alicePub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, bobPub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	earlyData := []byte("early data")
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		noiseHandshake(NoiseConfig{
+			Pattern:          NoiseIK,
+			Initiator:        true,
+			StaticPrivateKey: aliceKey,
+			RemoteStaticKey:  bobPub,
+			EarlyData:        earlyData,
+		}),
+		noiseHandshake(NoiseConfig{
+			Pattern:          NoiseIK,
+			StaticPrivateKey: bobKey,
+			AcceptEarlyData:  true,
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(bobEncrypted.PeerStaticKey(), alicePub) {
+		t.Fatal("bob got wrong peer static key")
+	}
+
+	err = read(bobEncrypted, earlyData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoiseIKRejectEarlyData(t *testing.T) {
+	aliceKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, bobPub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := net.Pipe()
+	_, _, err = handshakePair(
+		bob,
+		alice,
+		noiseHandshake(NoiseConfig{Pattern: NoiseIK, StaticPrivateKey: bobKey}),
+		noiseHandshake(NoiseConfig{
+			Pattern:          NoiseIK,
+			Initiator:        true,
+			StaticPrivateKey: aliceKey,
+			RemoteStaticKey:  bobPub,
+			EarlyData:        []byte("early data"),
+		}),
+	)
+	if err != ErrEarlyDataRejected {
+		t.Fatalf("expect error %v, got %v", ErrEarlyDataRejected, err)
+	}
+}
+
+func TestNoiseIKWrongRemoteStaticKey(t *testing.T) {
+	aliceKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherPub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := net.Pipe()
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		noiseHandshake(NoiseConfig{Pattern: NoiseIK, Initiator: true, StaticPrivateKey: aliceKey, RemoteStaticKey: otherPub}),
+		noiseHandshake(NoiseConfig{Pattern: NoiseIK, StaticPrivateKey: bobKey}),
+	)
+	if err == nil {
+		t.Fatal("handshake with wrong remote static key should fail")
+	}
+}
+
+func TestNoiseKK(t *testing.T) {
+	aliceKey, alicePub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, bobPub, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		noiseHandshake(NoiseConfig{Pattern: NoiseKK, Initiator: true, StaticPrivateKey: aliceKey, RemoteStaticKey: bobPub}),
+		noiseHandshake(NoiseConfig{Pattern: NoiseKK, StaticPrivateKey: bobKey, RemoteStaticKey: alicePub}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(aliceEncrypted.PeerStaticKey(), bobPub) || !bytes.Equal(bobEncrypted.PeerStaticKey(), alicePub) {
+		t.Fatal("wrong peer static key")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
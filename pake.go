@@ -0,0 +1,267 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// pakeProtocolName identifies the PAKE handshake protocol and is the first
+	// thing mixed into the transcript that session keys are derived from.
+	pakeProtocolName = "EncryptedStream_SPAKE2_Edwards25519_SHA256"
+
+	// pakePasswordContext is prepended to password when hashing it to scalar.
+	pakePasswordContext = "encrypted-stream SPAKE2 password"
+
+	// pakeConfirmationInfo is the HKDF info used to derive confirmation keys.
+	pakeConfirmationInfo = "ConfirmationKeys"
+)
+
+// ErrPasswordMismatch indicates the password authenticated key exchange
+// failed, usually because two sides used different passwords.
+var ErrPasswordMismatch = errors.New("password mismatch")
+
+// SPAKE2 M and N points for edwards25519 defined in RFC 9382. Nobody knows
+// their discrete logarithm with respect to the generator.
+var (
+	pakePointM = mustDecodePoint("d048032c6ea0b6d697ddc2e86bda85a33adac920f1bf18e1b0c6d166a5cecdaf")
+	pakePointN = mustDecodePoint("d3bfb518f44f3430f29d0c92af503865a1ed3281dc69b35dd868ba85f886c4ab")
+)
+
+// PAKEConfig is the configuration for PAKEHandshake.
+type PAKEConfig struct {
+	// Initiator indicates the direction of the handshake (initiator or
+	// responder). Two sides of the handshake should set this to different value.
+	Initiator bool
+
+	// Password is the shared (possibly low-entropy) password, e.g. a short
+	// pairing code. Both sides should use the same password.
+	Password []byte
+
+	// InitiatorIdentity and ResponderIdentity are optional identities of the
+	// two sides that will be bound to the session key. Both sides should use the
+	// same values.
+	InitiatorIdentity []byte
+	ResponderIdentity []byte
+
+	// Config is the config of the encrypted stream created after handshake. It
+	// will be merged with the default config. Cipher, Initiator and
+	// SequentialNonce will be set by handshake and should be left empty.
+	Config *Config
+}
+
+// PAKEHandshake performs a SPAKE2 (RFC 9382) password authenticated key
+// exchange over edwards25519 with explicit key confirmation, and creates an
+// EncryptedStream from the resulting session key. Unlike using a key derived
+// directly from password, an attacker can only test one password guess per
+// handshake it participates in, and passively observed handshakes do not help
+// an offline dictionary attack. Returns ErrPasswordMismatch if the two sides
+// used different passwords. Applications should still rate limit failed
+// handshakes when the password is short.
+func PAKEHandshake(conn io.ReadWriter, config *PAKEConfig) (*EncryptedStream, error) {
+	if config == nil {
+		return nil, errors.New("nil pake config")
+	}
+
+	if len(config.Password) == 0 {
+		return nil, errors.New("empty password")
+	}
+
+	w, err := pakePasswordScalar(config)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+
+	// Initiator sends T = x*G + w*M, and responder sends S = x*G + w*N.
+	localBlind, peerBlind := pakePointM, pakePointN
+	if !config.Initiator {
+		localBlind, peerBlind = pakePointN, pakePointM
+	}
+
+	localShare := new(edwards25519.Point).ScalarBaseMult(x)
+	localShare.Add(localShare, new(edwards25519.Point).ScalarMult(w, localBlind))
+	localMsg := localShare.Bytes()
+
+	params, err := newStreamParameters(config.Config, CipherSuiteChaCha20Poly1305)
+	if err != nil {
+		return nil, err
+	}
+	localParams := params.marshal()
+
+	var peerMsg, peerConfirmation, peerParams []byte
+	if config.Initiator {
+		err = writeHandshakeMessage(conn, localMsg, localParams)
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := readHandshakeMessage(conn, 3)
+		if err != nil {
+			return nil, err
+		}
+		peerMsg, peerConfirmation, peerParams = fields[0], fields[1], fields[2]
+
+		err = params.check(peerParams)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fields, err := readHandshakeMessage(conn, 2)
+		if err != nil {
+			return nil, err
+		}
+		peerMsg, peerParams = fields[0], fields[1]
+
+		err = params.check(peerParams)
+		if err != nil {
+			writeHandshakeMessage(conn, localMsg, nil, localParams)
+			return nil, err
+		}
+	}
+
+	peerShare, err := new(edwards25519.Point).SetBytes(peerMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	// K = h*x*(peerShare - w*peerBlind)
+	k := new(edwards25519.Point).Subtract(peerShare, new(edwards25519.Point).ScalarMult(w, peerBlind))
+	k.MultByCofactor(k)
+	k.ScalarMult(x, k)
+	if k.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, errors.New("invalid peer share")
+	}
+
+	initiatorMsg, responderMsg := localMsg, peerMsg
+	if !config.Initiator {
+		initiatorMsg, responderMsg = peerMsg, localMsg
+	}
+
+	tt := pakeTranscript(config.InitiatorIdentity, config.ResponderIdentity, initiatorMsg, responderMsg, k.Bytes(), w.Bytes())
+	ttHash := sha256.Sum256(tt)
+	ke, ka := ttHash[:16], ttHash[16:]
+
+	r := hkdf.New(sha256.New, ka, nil, []byte(pakeConfirmationInfo))
+	confirmationKeys := make([]byte, 32)
+	_, err = io.ReadFull(r, confirmationKeys)
+	if err != nil {
+		return nil, err
+	}
+	initiatorConfirmation := pakeConfirmation(confirmationKeys[:16], tt)
+	responderConfirmation := pakeConfirmation(confirmationKeys[16:], tt)
+
+	if config.Initiator {
+		if !hmac.Equal(peerConfirmation, responderConfirmation) {
+			return nil, ErrPasswordMismatch
+		}
+
+		err = writeHandshakeMessage(conn, initiatorConfirmation)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = writeHandshakeMessage(conn, localMsg, responderConfirmation, localParams)
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := readHandshakeMessage(conn, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if !hmac.Equal(fields[0], initiatorConfirmation) {
+			return nil, ErrPasswordMismatch
+		}
+	}
+
+	// Stream parameters are bound to session keys rather than key confirmation
+	// so that confirmation stays the same as RFC 9382.
+	initiatorParams, responderParams := localParams, peerParams
+	if !config.Initiator {
+		initiatorParams, responderParams = peerParams, localParams
+	}
+	t := newTranscript(pakeProtocolName)
+	t.add(ttHash[:], initiatorParams, responderParams)
+	th := t.sum()
+
+	keys, err := deriveSessionKeys(ke, th, config.Initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := newHandshakeStream(conn, config.Config, config.Initiator, CipherSuiteChaCha20Poly1305, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = es.setExporter(ke, th)
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+// pakePasswordScalar hashes password and identities to a scalar.
+func pakePasswordScalar(config *PAKEConfig) (*edwards25519.Scalar, error) {
+	h := sha512.New()
+	t := &transcript{hash: h}
+	t.add([]byte(pakePasswordContext), config.InitiatorIdentity, config.ResponderIdentity, config.Password)
+	return edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+}
+
+// pakeTranscript returns the transcript TT defined in RFC 9382.
+func pakeTranscript(data ...[]byte) []byte {
+	var b []byte
+	var lenBuf [8]byte
+	for _, d := range data {
+		binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(d)))
+		b = append(b, lenBuf[:]...)
+		b = append(b, d...)
+	}
+	return b
+}
+
+// pakeConfirmation computes the key confirmation MAC of a transcript.
+func pakeConfirmation(key, tt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(tt)
+	return mac.Sum(nil)
+}
+
+// randomScalar returns a uniformly random edwards25519 scalar.
+func randomScalar() (*edwards25519.Scalar, error) {
+	b := make([]byte, 64)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return edwards25519.NewScalar().SetUniformBytes(b)
+}
+
+func mustDecodePoint(s string) *edwards25519.Point {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	p, err := new(edwards25519.Point).SetBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func pakeHandshake(config PAKEConfig) handshakeFunc {
+	return func(conn io.ReadWriter) (*EncryptedStream, error) {
+		return PAKEHandshake(conn, &config)
+	}
+}
+
+func TestPAKEHandshake(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		pakeHandshake(PAKEConfig{Initiator: true, Password: []byte("123456"), InitiatorIdentity: []byte("phone")}),
+		pakeHandshake(PAKEConfig{Password: []byte("123456"), InitiatorIdentity: []byte("phone")}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPAKEHandshakeWrongPassword(t *testing.T) {
+	alice, bob := net.Pipe()
+	_, _, err := handshakePair(
+		alice,
+		bob,
+		pakeHandshake(PAKEConfig{Initiator: true, Password: []byte("123456")}),
+		pakeHandshake(PAKEConfig{Password: []byte("123457")}),
+	)
+	if err != ErrPasswordMismatch {
+		t.Fatalf("expect error %v, got %v", ErrPasswordMismatch, err)
+	}
+}
+
+func TestPAKEHandshakeIdentityMismatch(t *testing.T) {
+	alice, bob := net.Pipe()
+	_, _, err := handshakePair(
+		alice,
+		bob,
+		pakeHandshake(PAKEConfig{Initiator: true, Password: []byte("123456"), ResponderIdentity: []byte("box1")}),
+		pakeHandshake(PAKEConfig{Password: []byte("123456"), ResponderIdentity: []byte("box2")}),
+	)
+	if err != ErrPasswordMismatch {
+		t.Fatalf("expect error %v, got %v", ErrPasswordMismatch, err)
+	}
+}
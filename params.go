@@ -0,0 +1,170 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// protocolVersion is the version of encrypted stream protocol.
+	protocolVersion = 1
+
+	// streamParametersSize is the size of encoded stream parameters.
+	streamParametersSize = 16
+)
+
+const (
+	streamParameterSequentialNonce byte = 1 << iota
+	streamParameterDisableNonceVerification
+	streamParameterKeyUpdate
+	streamParameterKeyIDs
+	streamParameterAuthenticateHeader
+	streamParameterEncryptLength
+)
+
+// ParameterMismatchError is returned by handshakes on both sides when the
+// parameters of the stream to be created are different on two sides, e.g.
+// they use different Config.MaxChunkSize. Stream parameters are authenticated
+// by the handshake, so an active attacker can not make the two sides use
+// different or weaker parameters without causing the handshake or the first
+// chunk to fail.
+type ParameterMismatchError struct {
+	// Parameter is the name of the mismatched parameter.
+	Parameter string
+
+	// Local and Remote are the values of the parameter on local and remote
+	// side.
+	Local  interface{}
+	Remote interface{}
+}
+
+func (e *ParameterMismatchError) Error() string {
+	return fmt.Sprintf("stream parameter %s mismatch: local %v, remote %v", e.Parameter, e.Local, e.Remote)
+}
+
+// streamParameters are the parameters of a stream that should be the same on
+// both sides. They are exchanged and authenticated by handshakes, or by
+// preamble (see Config.Preamble) for streams created by NewEncryptedStream.
+type streamParameters struct {
+	version                  uint8
+	cipherSuite              CipherSuite
+	maxChunkSize             uint32
+	sequentialNonce          bool
+	disableNonceVerification bool
+	keyUpdate                bool
+	keyIDs                   bool
+	authenticateHeader       bool
+	encryptLength            bool
+	ratchetInterval          uint64
+}
+
+// newStreamParameters returns the parameters of a stream created by a handshake
+// with the given config and cipher suite. Cipher suite can be zero if it is
+// negotiated by the handshake and not known yet. Sequential nonce is always true
+// as handshakes always use sequential nonce regardless of config, and is only
+// compared when parameters are exchanged by preamble.
+func newStreamParameters(config *Config, suite CipherSuite) (*streamParameters, error) {
+	config, err := MergeConfig(DefaultConfig(), config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.MaxChunkSize <= 0 || uint64(config.MaxChunkSize) > uint64(^uint32(0)) {
+		return nil, errors.New("invalid max chunk size")
+	}
+
+	return &streamParameters{
+		version:                  protocolVersion,
+		cipherSuite:              suite,
+		maxChunkSize:             uint32(config.MaxChunkSize),
+		sequentialNonce:          true,
+		disableNonceVerification: config.DisableNonceVerification,
+		keyUpdate:                config.KeyUpdate,
+		keyIDs:                   config.KeyIDs,
+		authenticateHeader:       config.AuthenticateHeader,
+		encryptLength:            config.EncryptLength,
+		ratchetInterval:          config.RatchetInterval,
+	}, nil
+}
+
+func (p *streamParameters) marshal() []byte {
+	b := make([]byte, streamParametersSize)
+	b[0] = p.version
+	binary.LittleEndian.PutUint16(b[1:3], uint16(p.cipherSuite))
+	binary.LittleEndian.PutUint32(b[3:7], p.maxChunkSize)
+	if p.sequentialNonce {
+		b[7] |= streamParameterSequentialNonce
+	}
+	if p.disableNonceVerification {
+		b[7] |= streamParameterDisableNonceVerification
+	}
+	if p.keyUpdate {
+		b[7] |= streamParameterKeyUpdate
+	}
+	if p.keyIDs {
+		b[7] |= streamParameterKeyIDs
+	}
+	if p.authenticateHeader {
+		b[7] |= streamParameterAuthenticateHeader
+	}
+	if p.encryptLength {
+		b[7] |= streamParameterEncryptLength
+	}
+	binary.LittleEndian.PutUint64(b[8:16], p.ratchetInterval)
+	return b
+}
+
+func unmarshalStreamParameters(b []byte) (*streamParameters, error) {
+	if len(b) != streamParametersSize {
+		return nil, errors.New("invalid stream parameters")
+	}
+
+	return &streamParameters{
+		version:                  b[0],
+		cipherSuite:              CipherSuite(binary.LittleEndian.Uint16(b[1:3])),
+		maxChunkSize:             binary.LittleEndian.Uint32(b[3:7]),
+		sequentialNonce:          b[7]&streamParameterSequentialNonce != 0,
+		disableNonceVerification: b[7]&streamParameterDisableNonceVerification != 0,
+		keyUpdate:                b[7]&streamParameterKeyUpdate != 0,
+		keyIDs:                   b[7]&streamParameterKeyIDs != 0,
+		authenticateHeader:       b[7]&streamParameterAuthenticateHeader != 0,
+		encryptLength:            b[7]&streamParameterEncryptLength != 0,
+		ratchetInterval:          binary.LittleEndian.Uint64(b[8:16]),
+	}, nil
+}
+
+// check returns a *ParameterMismatchError if peer's encoded stream parameters
+// are different from local ones. Cipher suite is only compared if it is known
+// by both sides.
+func (p *streamParameters) check(b []byte) error {
+	peer, err := unmarshalStreamParameters(b)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case p.version != peer.version:
+		return &ParameterMismatchError{Parameter: "Version", Local: p.version, Remote: peer.version}
+	case p.cipherSuite != 0 && peer.cipherSuite != 0 && p.cipherSuite != peer.cipherSuite:
+		return &ParameterMismatchError{Parameter: "CipherSuite", Local: p.cipherSuite, Remote: peer.cipherSuite}
+	case p.maxChunkSize != peer.maxChunkSize:
+		return &ParameterMismatchError{Parameter: "MaxChunkSize", Local: p.maxChunkSize, Remote: peer.maxChunkSize}
+	case p.sequentialNonce != peer.sequentialNonce:
+		return &ParameterMismatchError{Parameter: "SequentialNonce", Local: p.sequentialNonce, Remote: peer.sequentialNonce}
+	case p.disableNonceVerification != peer.disableNonceVerification:
+		return &ParameterMismatchError{Parameter: "DisableNonceVerification", Local: p.disableNonceVerification, Remote: peer.disableNonceVerification}
+	case p.keyUpdate != peer.keyUpdate:
+		return &ParameterMismatchError{Parameter: "KeyUpdate", Local: p.keyUpdate, Remote: peer.keyUpdate}
+	case p.keyIDs != peer.keyIDs:
+		return &ParameterMismatchError{Parameter: "KeyIDs", Local: p.keyIDs, Remote: peer.keyIDs}
+	case p.authenticateHeader != peer.authenticateHeader:
+		return &ParameterMismatchError{Parameter: "AuthenticateHeader", Local: p.authenticateHeader, Remote: peer.authenticateHeader}
+	case p.encryptLength != peer.encryptLength:
+		return &ParameterMismatchError{Parameter: "EncryptLength", Local: p.encryptLength, Remote: peer.encryptLength}
+	case p.ratchetInterval != peer.ratchetInterval:
+		return &ParameterMismatchError{Parameter: "RatchetInterval", Local: p.ratchetInterval, Remote: peer.ratchetInterval}
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package stream
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func parameterMismatchTest(t *testing.T, aliceHandshake, bobHandshake handshakeFunc, parameter string) {
+	alice, bob := net.Pipe()
+
+	bobChan := make(chan error, 1)
+	go func() {
+		_, err := bobHandshake(bob)
+		bob.Close()
+		bobChan <- err
+	}()
+
+	_, aliceErr := aliceHandshake(alice)
+	alice.Close()
+	bobErr := <-bobChan
+
+	for _, err := range []error{aliceErr, bobErr} {
+		var mismatchErr *ParameterMismatchError
+		if !errors.As(err, &mismatchErr) {
+			t.Fatalf("expect *ParameterMismatchError, got %v", err)
+		}
+		if mismatchErr.Parameter != parameter {
+			t.Fatalf("expect mismatched parameter %s, got %s", parameter, mismatchErr.Parameter)
+		}
+	}
+}
+
+func TestHandshakeParameterMismatch(t *testing.T) {
+	parameterMismatchTest(
+		t,
+		handshake(HandshakeConfig{Initiator: true, Config: &Config{MaxChunkSize: 1024}}),
+		handshake(HandshakeConfig{}),
+		"MaxChunkSize",
+	)
+}
+
+func TestNoiseParameterMismatch(t *testing.T) {
+	aliceKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, _, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parameterMismatchTest(
+		t,
+		noiseHandshake(NoiseConfig{Initiator: true, StaticPrivateKey: aliceKey}),
+		noiseHandshake(NoiseConfig{StaticPrivateKey: bobKey, Config: &Config{DisableNonceVerification: true}}),
+		"DisableNonceVerification",
+	)
+}
+
+func TestPAKEParameterMismatch(t *testing.T) {
+	password := []byte("123456")
+	parameterMismatchTest(
+		t,
+		pakeHandshake(PAKEConfig{Initiator: true, Password: password, Config: &Config{MaxChunkSize: 1024}}),
+		pakeHandshake(PAKEConfig{Password: password}),
+		"MaxChunkSize",
+	)
+}
+
+func TestPSKParameterMismatch(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyLookup := func(id []byte) ([]byte, error) {
+		return key, nil
+	}
+
+	parameterMismatchTest(
+		t,
+		pskHandshake(PSKConfig{Initiator: true, Key: key}),
+		pskHandshake(PSKConfig{KeyLookup: keyLookup, Config: &Config{MaxChunkSize: 1024}}),
+		"MaxChunkSize",
+	)
+}
+
+func TestMasterKeyParameterMismatch(t *testing.T) {
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parameterMismatchTest(
+		t,
+		masterKeyHandshake(MasterKeyConfig{Initiator: true, MasterKey: masterKey, CipherSuite: CipherSuiteAES256GCM}),
+		masterKeyHandshake(MasterKeyConfig{MasterKey: masterKey}),
+		"CipherSuite",
+	)
+}
+
+func TestHandshakeParametersTampered(t *testing.T) {
+	alice, mitmAlice := net.Pipe()
+	mitmBob, bob := net.Pipe()
+
+	tamper := func(fields [][]byte, maxChunkSize uint32) {
+		for i, field := range fields {
+			if len(field) > 0 && field[0] == extensionStreamParameters {
+				params, err := unmarshalStreamParameters(field[1:])
+				if err != nil {
+					return
+				}
+				params.maxChunkSize = maxChunkSize
+				fields[i] = extension(extensionStreamParameters, params.marshal())
+			}
+		}
+	}
+
+	// Make both sides see matching parameters while they use different
+	// MaxChunkSize, then forward data from alice to bob.
+	go func() {
+		fields, err := readHandshakeMessage(mitmAlice, 1)
+		if err != nil {
+			return
+		}
+		tamper(fields, 1024)
+		writeHandshakeMessage(mitmBob, fields...)
+
+		fields, err = readHandshakeMessage(mitmBob, 1)
+		if err != nil {
+			return
+		}
+		tamper(fields, uint32(DefaultConfig().MaxChunkSize))
+		writeHandshakeMessage(mitmAlice, fields...)
+
+		io.Copy(mitmBob, mitmAlice)
+	}()
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true}),
+		handshake(HandshakeConfig{Config: &Config{MaxChunkSize: 1024}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go aliceEncrypted.Write([]byte("hello"))
+
+	// Tampered transcript results in different session keys.
+	_, err = bobEncrypted.Read(make([]byte, 5))
+	if err == nil {
+		t.Fatal("tampered stream parameters should be detected")
+	}
+}
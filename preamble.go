@@ -0,0 +1,258 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// minProtocolVersion is the min protocol version supported. Version 0 is
+	// reserved for the legacy format without preamble.
+	minProtocolVersion = 1
+
+	// preambleMagic is sent at the beginning of preamble. When interpreted as
+	// the 4 bytes little-endian length prefix of legacy format, it is larger
+	// than any valid encrypted chunk, so it can be distinguished from a legacy
+	// stream.
+	preambleMagic = "ESTM"
+)
+
+// ErrNoCommonProtocolVersion is returned by NewEncryptedStream on both sides
+// when preamble is enabled and two sides do not support any common protocol
+// version.
+var ErrNoCommonProtocolVersion = errors.New("no common protocol version")
+
+// ErrInvalidPreamble is returned by NewEncryptedStream when preamble is
+// required but peer does not send a valid one, e.g. peer is not an encrypted
+// stream or uses the legacy format.
+var ErrInvalidPreamble = errors.New("invalid preamble")
+
+// ErrPreambleMismatch is returned by NewEncryptedStream when the preamble
+// confirmed by peer is different from the one sent and received locally, which
+// means preamble is modified in transit, e.g. to downgrade protocol version.
+var ErrPreambleMismatch = errors.New("preamble mismatch")
+
+// maxLegacyChunkSize returns the max size that a legacy chunk can have without
+// being confused with preamble magic.
+func maxLegacyChunkSize() int {
+	return int(binary.LittleEndian.Uint32([]byte(preambleMagic))) - 1
+}
+
+// exchangePreamble sends and receives preamble and sets the negotiated
+// protocol version of the stream. Preamble also carries the stream parameters
+// of each side, so that mismatched config fails with *ParameterMismatchError
+// on both sides. Preamble is sent in plaintext, so once a version is
+// negotiated, both sides confirm the preamble they have seen with an encrypted
+// chunk, and a modified preamble fails on both sides.
+func (es *EncryptedStream) exchangePreamble() error {
+	if es.config.Initiator {
+		initiatorPreamble, responderPreamble, err := es.writeInitiatorPreamble()
+		if err != nil {
+			return err
+		}
+
+		transcript := append(initiatorPreamble, responderPreamble...)
+
+		err = es.readPreambleConfirmation(transcript)
+		if err != nil {
+			return err
+		}
+
+		return es.writePreambleConfirmation(transcript)
+	}
+
+	initiatorPreamble, responderPreamble, err := es.readInitiatorPreamble()
+	if err != nil || responderPreamble == nil {
+		return err
+	}
+
+	transcript := append(initiatorPreamble, responderPreamble...)
+
+	err = es.writePreambleConfirmation(transcript)
+	if err != nil {
+		return err
+	}
+
+	return es.readPreambleConfirmation(transcript)
+}
+
+// preambleParameters returns the stream parameters sent in preamble. Unlike
+// handshakes, sequential nonce is configurable here.
+func (es *EncryptedStream) preambleParameters() (*streamParameters, error) {
+	params, err := newStreamParameters(es.config, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	params.sequentialNonce = es.config.SequentialNonce
+
+	return params, nil
+}
+
+// writeInitiatorPreamble is called by initiator to send magic, the range of
+// supported versions and stream parameters, and read the version selected by
+// responder and its stream parameters. Returns the preamble sent and received.
+func (es *EncryptedStream) writeInitiatorPreamble() ([]byte, []byte, error) {
+	params, err := es.preambleParameters()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initiatorPreamble := append([]byte(preambleMagic), minProtocolVersion, protocolVersion)
+	initiatorPreamble = append(initiatorPreamble, params.marshal()...)
+	_, err = es.stream.Write(initiatorPreamble)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	responderPreamble := make([]byte, len(preambleMagic)+1+streamParametersSize)
+	_, err = io.ReadFull(es.stream, responderPreamble)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if string(responderPreamble[:len(preambleMagic)]) != preambleMagic {
+		return nil, nil, ErrInvalidPreamble
+	}
+
+	version := responderPreamble[len(preambleMagic)]
+	if version == 0 {
+		return nil, nil, ErrNoCommonProtocolVersion
+	}
+
+	if version < minProtocolVersion || version > protocolVersion {
+		return nil, nil, errors.New("peer selected unsupported protocol version")
+	}
+
+	err = params.check(responderPreamble[len(preambleMagic)+1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	es.protocolVersion = version
+
+	return initiatorPreamble, responderPreamble, nil
+}
+
+// readInitiatorPreamble is called by responder to read initiator's preamble
+// and reply with the selected version and its stream parameters. Returns the
+// preamble received and sent. If initiator uses legacy format and preamble is
+// not required, the bytes already read are kept for the first read, and nil
+// preamble is returned.
+func (es *EncryptedStream) readInitiatorPreamble() ([]byte, []byte, error) {
+	params, err := es.preambleParameters()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initiatorPreamble := make([]byte, len(preambleMagic)+2+streamParametersSize)
+	_, err = io.ReadFull(es.stream, initiatorPreamble[:len(preambleMagic)])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if string(initiatorPreamble[:len(preambleMagic)]) != preambleMagic {
+		if es.config.RequirePreamble {
+			return nil, nil, ErrInvalidPreamble
+		}
+		es.reader = io.MultiReader(bytes.NewReader(initiatorPreamble[:len(preambleMagic)]), es.stream)
+		return nil, nil, nil
+	}
+
+	_, err = io.ReadFull(es.stream, initiatorPreamble[len(preambleMagic):])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version := selectProtocolVersion(initiatorPreamble[len(preambleMagic)], initiatorPreamble[len(preambleMagic)+1])
+
+	responderPreamble := append([]byte(preambleMagic), version)
+	responderPreamble = append(responderPreamble, params.marshal()...)
+	_, err = es.stream.Write(responderPreamble)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if version == 0 {
+		return nil, nil, ErrNoCommonProtocolVersion
+	}
+
+	err = params.check(initiatorPreamble[len(preambleMagic)+2:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	es.protocolVersion = version
+
+	return initiatorPreamble, responderPreamble, nil
+}
+
+// preambleConfirmation returns the plaintext of the preamble confirmation sent
+// by initiator or responder. The sender is included so that a confirmation can
+// not be reflected back to its sender.
+func preambleConfirmation(transcript []byte, initiator bool) []byte {
+	b := make([]byte, len(transcript)+1)
+	copy(b, transcript)
+	if initiator {
+		b[len(transcript)] = 1
+	}
+	return b
+}
+
+// writePreambleConfirmation sends the preamble seen by local side as an
+// encrypted chunk.
+func (es *EncryptedStream) writePreambleConfirmation(transcript []byte) error {
+	ciphertext, err := es.encoder.Encode(es.encryptBuffer, preambleConfirmation(transcript, es.config.Initiator))
+	if err != nil {
+		return err
+	}
+
+	return es.writeChunk(ciphertext)
+}
+
+// readPreambleConfirmation reads and decrypts the preamble confirmation sent by
+// peer, and returns ErrPreambleMismatch if it is different from the preamble
+// seen by local side.
+func (es *EncryptedStream) readPreambleConfirmation(transcript []byte) error {
+	n, err := es.readChunk()
+	if err != nil {
+		return err
+	}
+
+	if n > es.config.maxEncryptedChunkSize() {
+		return fmt.Errorf("received invalid encrypted data size %d", n)
+	}
+
+	plaintext, err := es.decoder.Decode(es.decryptBuffer[:cap(es.decryptBuffer)], es.readBuffer[:n])
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(plaintext, preambleConfirmation(transcript, !es.config.Initiator)) {
+		return ErrPreambleMismatch
+	}
+
+	return nil
+}
+
+// selectProtocolVersion returns the highest protocol version supported by
+// both local and peer, or 0 if there is none.
+func selectProtocolVersion(peerMin, peerMax byte) byte {
+	version := byte(protocolVersion)
+	if peerMax < version {
+		version = peerMax
+	}
+	if version < minProtocolVersion || version < peerMin {
+		return 0
+	}
+	return version
+}
+
+// ProtocolVersion returns the protocol version negotiated by preamble, or 0
+// if preamble is not used (legacy format).
+func (es *EncryptedStream) ProtocolVersion() int {
+	return int(es.protocolVersion)
+}
@@ -0,0 +1,210 @@
+package stream
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+func newStream(config Config) handshakeFunc {
+	return func(conn io.ReadWriter) (*EncryptedStream, error) {
+		return NewEncryptedStream(conn, &config)
+	}
+}
+
+func TestPreamble(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := NewChaCha20Poly1305Cipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		newStream(Config{Cipher: cipher, Initiator: true, Preamble: true}),
+		newStream(Config{Cipher: cipher, Preamble: true, RequirePreamble: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aliceEncrypted.ProtocolVersion() != protocolVersion || bobEncrypted.ProtocolVersion() != protocolVersion {
+		t.Fatalf("expect protocol version %d, got %d and %d", protocolVersion, aliceEncrypted.ProtocolVersion(), bobEncrypted.ProtocolVersion())
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreambleLegacyInitiator(t *testing.T) {
+	cipher := NewXSalsa20Poly1305Cipher(new([32]byte))
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, err := NewEncryptedStream(alice, &Config{Cipher: cipher, Initiator: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Responder waits for the first bytes from initiator.
+	data := []byte("hello")
+	go write(aliceEncrypted, data)
+
+	bobEncrypted, err := NewEncryptedStream(bob, &Config{Cipher: cipher, Preamble: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bobEncrypted.ProtocolVersion() != 0 {
+		t.Fatalf("expect protocol version 0, got %d", bobEncrypted.ProtocolVersion())
+	}
+
+	err = read(bobEncrypted, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreambleRequired(t *testing.T) {
+	alice, bob := net.Pipe()
+
+	go func() {
+		writeVarBytes(alice, make([]byte, 64), nil)
+		alice.Close()
+	}()
+
+	_, err := NewEncryptedStream(bob, &Config{
+		Cipher:          NewXSalsa20Poly1305Cipher(new([32]byte)),
+		Preamble:        true,
+		RequirePreamble: true,
+	})
+	if err != ErrInvalidPreamble {
+		t.Fatalf("expect error %v, got %v", ErrInvalidPreamble, err)
+	}
+}
+
+func TestPreambleNoCommonVersion(t *testing.T) {
+	alice, bob := net.Pipe()
+
+	go func() {
+		alice.Write(append(append([]byte(preambleMagic), protocolVersion+1, protocolVersion+2), make([]byte, streamParametersSize)...))
+		alice.Read(make([]byte, len(preambleMagic)+1+streamParametersSize))
+		alice.Close()
+	}()
+
+	_, err := NewEncryptedStream(bob, &Config{
+		Cipher:   NewXSalsa20Poly1305Cipher(new([32]byte)),
+		Preamble: true,
+	})
+	if err != ErrNoCommonProtocolVersion {
+		t.Fatalf("expect error %v, got %v", ErrNoCommonProtocolVersion, err)
+	}
+}
+
+// versionRangeTamperer increases the max version offered in the first write,
+// which is the preamble of initiator.
+type versionRangeTamperer struct {
+	io.Writer
+	tampered bool
+}
+
+func (w *versionRangeTamperer) Write(b []byte) (int, error) {
+	if !w.tampered && len(b) == len(preambleMagic)+2+streamParametersSize {
+		w.tampered = true
+		b = append([]byte(nil), b...)
+		b[len(preambleMagic)+1]++
+	}
+	return w.Writer.Write(b)
+}
+
+func TestPreambleTampered(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice = &readWriteCloser{Reader: alice, Writer: &versionRangeTamperer{Writer: alice}, Closer: alice}
+
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		newStream(Config{Cipher: cipher, Initiator: true, Preamble: true}),
+		newStream(Config{Cipher: cipher, Preamble: true}),
+	)
+	if err != ErrPreambleMismatch {
+		t.Fatalf("expect error %v, got %v", ErrPreambleMismatch, err)
+	}
+}
+
+func TestSelectProtocolVersion(t *testing.T) {
+	tests := []struct {
+		peerMin, peerMax, expected byte
+	}{
+		{minProtocolVersion, protocolVersion, protocolVersion},
+		{minProtocolVersion, protocolVersion + 1, protocolVersion},
+		{protocolVersion + 1, protocolVersion + 2, 0},
+		{0, 0, 0},
+	}
+
+	for _, test := range tests {
+		version := selectProtocolVersion(test.peerMin, test.peerMax)
+		if version != test.expected {
+			t.Fatalf("select protocol version with peer range [%d, %d]: expect %d, got %d", test.peerMin, test.peerMax, test.expected, version)
+		}
+	}
+}
+
+func TestPreambleParameterMismatch(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		config    Config
+		parameter string
+	}{
+		{Config{SequentialNonce: true}, "SequentialNonce"},
+		{Config{MaxChunkSize: 1024}, "MaxChunkSize"},
+	}
+
+	for _, test := range tests {
+		aliceConfig := test.config
+		aliceConfig.Cipher = cipher
+		aliceConfig.Initiator = true
+		aliceConfig.Preamble = true
+
+		parameterMismatchTest(
+			t,
+			newStream(aliceConfig),
+			newStream(Config{Cipher: cipher, Preamble: true}),
+			test.parameter,
+		)
+	}
+}
@@ -0,0 +1,207 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// pskProtocolName identifies the PSK handshake protocol and is the first
+	// thing mixed into handshake transcript.
+	pskProtocolName = "EncryptedStream_PSK_SHA256"
+
+	// pskConfirmationInfo is the HKDF info used to derive confirmation keys.
+	pskConfirmationInfo = "encrypted-stream psk confirmation keys"
+
+	// pskSaltSize is the size of random salt sent by each side.
+	pskSaltSize = 32
+)
+
+// UnknownKeyIDError is returned by PSKHandshake when responder can not find the
+// pre-shared key of the key ID sent by initiator. It is returned on both sides
+// of the handshake.
+type UnknownKeyIDError struct {
+	KeyID []byte
+}
+
+func (e *UnknownKeyIDError) Error() string {
+	return fmt.Sprintf("unknown pre-shared key id %x", e.KeyID)
+}
+
+// PSKConfig is the configuration for PSKHandshake.
+type PSKConfig struct {
+	// Initiator indicates the direction of the handshake (initiator or
+	// responder). Two sides of the handshake should set this to different value.
+	Initiator bool
+
+	// KeyID is the identifier of the pre-shared key that initiator sends to
+	// responder in plaintext. Only used by initiator.
+	KeyID []byte
+
+	// Key is the pre-shared key of KeyID. It should have high entropy (e.g. 32
+	// random bytes); use PAKEHandshake for passwords. Only used by initiator.
+	Key []byte
+
+	// KeyLookup returns the pre-shared key of a key ID sent by initiator. If it
+	// returns a nil key and nil error, handshake fails with
+	// *UnknownKeyIDError. Only used by responder.
+	KeyLookup func(id []byte) ([]byte, error)
+
+	// Config is the config of the encrypted stream created after handshake. It
+	// will be merged with the default config. Cipher, Initiator and
+	// SequentialNonce will be set by handshake and should be left empty.
+	Config *Config
+}
+
+// PSKHandshake performs a pre-shared key handshake over the given ReadWriter.
+// Initiator sends a key ID and a random salt, responder resolves the key using
+// KeyLookup and replies with its own random salt, then both sides derive a
+// unique session key for each direction from the pre-shared key and both salts,
+// and confirm that the other side has the same key. Because session keys are
+// unique for every stream, sequential nonce can be safely used even if the same
+// pre-shared key is used by many streams. Note that PSK handshake does not
+// provide forward secrecy: if the pre-shared key is compromised, all streams
+// using it can be decrypted.
+func PSKHandshake(conn io.ReadWriter, config *PSKConfig) (*EncryptedStream, error) {
+	if config == nil {
+		return nil, errors.New("nil psk config")
+	}
+
+	salt := make([]byte, pskSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := newStreamParameters(config.Config, CipherSuiteChaCha20Poly1305)
+	if err != nil {
+		return nil, err
+	}
+	localParams := params.marshal()
+
+	t := newTranscript(pskProtocolName)
+
+	var key []byte
+	var peerConfirmation []byte
+	if config.Initiator {
+		if len(config.Key) == 0 {
+			return nil, errors.New("empty pre-shared key")
+		}
+		key = config.Key
+
+		err = writeHandshakeMessage(conn, config.KeyID, salt, localParams)
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := readHandshakeMessage(conn, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, &UnknownKeyIDError{KeyID: config.KeyID}
+		}
+		if len(fields) < 3 || len(fields[0]) != pskSaltSize {
+			return nil, errors.New("invalid psk handshake message")
+		}
+
+		err = params.check(fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		t.add(config.KeyID, salt, fields[0], localParams, fields[2])
+		peerConfirmation = fields[1]
+	} else {
+		if config.KeyLookup == nil {
+			return nil, errors.New("nil key lookup")
+		}
+
+		fields, err := readHandshakeMessage(conn, 3)
+		if err != nil {
+			return nil, err
+		}
+		keyID, peerSalt, peerParams := fields[0], fields[1], fields[2]
+		if len(peerSalt) != pskSaltSize {
+			return nil, errors.New("invalid psk handshake message")
+		}
+
+		err = params.check(peerParams)
+		if err != nil {
+			writeHandshakeMessage(conn, salt, nil, localParams)
+			return nil, err
+		}
+
+		key, err = config.KeyLookup(keyID)
+		if err == nil && len(key) == 0 {
+			err = &UnknownKeyIDError{KeyID: keyID}
+		}
+		if err != nil {
+			writeHandshakeMessage(conn)
+			return nil, err
+		}
+
+		t.add(keyID, peerSalt, salt, peerParams, localParams)
+	}
+
+	th := t.sum()
+	confirmationKeys, err := deriveDirectionalKeys(key, th, pskConfirmationInfo, config.Initiator)
+	if err != nil {
+		return nil, err
+	}
+	confirmation := pskConfirmation(confirmationKeys.encryptKey, th)
+	expectedConfirmation := pskConfirmation(confirmationKeys.decryptKey, th)
+
+	if config.Initiator {
+		if !hmac.Equal(peerConfirmation, expectedConfirmation) {
+			return nil, errors.New("pre-shared key mismatch")
+		}
+
+		err = writeHandshakeMessage(conn, confirmation)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = writeHandshakeMessage(conn, salt, confirmation, localParams)
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := readHandshakeMessage(conn, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if !hmac.Equal(fields[0], expectedConfirmation) {
+			return nil, errors.New("pre-shared key mismatch")
+		}
+	}
+
+	keys, err := deriveSessionKeys(key, th, config.Initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := newHandshakeStream(conn, config.Config, config.Initiator, CipherSuiteChaCha20Poly1305, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = es.setExporter(key, th)
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+// pskConfirmation computes the key confirmation MAC of a transcript hash.
+func pskConfirmation(key, th []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(th)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+func pskHandshake(config PSKConfig) handshakeFunc {
+	return func(conn io.ReadWriter) (*EncryptedStream, error) {
+		return PSKHandshake(conn, &config)
+	}
+}
+
+func TestPSKHandshake(t *testing.T) {
+	keys := make(map[string][]byte)
+	for _, id := range []string{"device1", "device2"} {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[id] = key
+	}
+
+	keyLookup := func(id []byte) ([]byte, error) {
+		return keys[string(id)], nil
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		pskHandshake(PSKConfig{Initiator: true, KeyID: []byte("device2"), Key: keys["device2"]}),
+		pskHandshake(PSKConfig{KeyLookup: keyLookup}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob = net.Pipe()
+	_, _, err = handshakePair(
+		alice,
+		bob,
+		pskHandshake(PSKConfig{Initiator: true, KeyID: []byte("device2"), Key: keys["device1"]}),
+		pskHandshake(PSKConfig{KeyLookup: keyLookup}),
+	)
+	if err == nil {
+		t.Fatal("handshake with wrong key should fail")
+	}
+}
+
+func TestPSKHandshakeUnknownKeyID(t *testing.T) {
+	keyLookup := func(id []byte) ([]byte, error) {
+		return nil, nil
+	}
+
+	for _, initiator := range []bool{true, false} {
+		alice, bob := net.Pipe()
+		aliceHandshake := pskHandshake(PSKConfig{Initiator: true, KeyID: []byte("device3"), Key: make([]byte, 32)})
+		bobHandshake := pskHandshake(PSKConfig{KeyLookup: keyLookup})
+		if !initiator {
+			alice, bob = bob, alice
+			aliceHandshake, bobHandshake = bobHandshake, aliceHandshake
+		}
+
+		_, _, err := handshakePair(alice, bob, aliceHandshake, bobHandshake)
+		unknownKeyIDErr, ok := err.(*UnknownKeyIDError)
+		if !ok {
+			t.Fatalf("expect UnknownKeyIDError, got %v", err)
+		}
+		if !bytes.Equal(unknownKeyIDErr.KeyID, []byte("device3")) {
+			t.Fatalf("expect key id device3, got %s", unknownKeyIDErr.KeyID)
+		}
+	}
+}
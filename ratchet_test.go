@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestRatchet(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{MaxChunkSize: 1024, RatchetInterval: 10}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, Config: config}),
+		handshake(HandshakeConfig{Config: config}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parameterMismatchTest(
+		t,
+		handshake(HandshakeConfig{Initiator: true, Config: config}),
+		handshake(HandshakeConfig{Config: &Config{MaxChunkSize: 1024}}),
+		"RatchetInterval",
+	)
+}
+
+func TestRatchetForwardSecrecy(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptCipher, err := NewChaCha20Poly1305Cipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decryptCipher, err := NewChaCha20Poly1305Cipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := newDirectionalCipher(encryptCipher, decryptCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoder, err := NewEncoder(cipher, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetRatchetInterval(1)
+
+	decoder, err := NewDecoder(cipher, false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.SetRatchetInterval(1)
+
+	previousKey := encryptCipher.key
+
+	plaintext := []byte("hello")
+	var chunks [][]byte
+	for i := 0; i < 3; i++ {
+		chunk, err := encoder.Encode(make([]byte, 128), plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if !bytes.Equal(previousKey, make([]byte, len(key))) {
+		t.Fatal("previous key should be erased")
+	}
+
+	// Current encoder state can not decrypt earlier chunks.
+	compromised := encoder.cipher
+	for _, chunk := range chunks {
+		nonceSize := compromised.NonceSize()
+		_, err = compromised.Decrypt(make([]byte, 128), chunk[nonceSize:], chunk[:nonceSize])
+		if err == nil {
+			t.Fatal("earlier chunk should not be decrypted with current key")
+		}
+	}
+
+	for _, chunk := range chunks {
+		decrypted, err := decoder.Decode(make([]byte, 128), chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decrypted data is different from plaintext")
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package stream
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// RekeyState is a snapshot of the key update state of a stream, returned by
+// EncryptedStream.RekeyState.
+type RekeyState struct {
+	// EncryptionKeyUpdates and DecryptionKeyUpdates are the number of times the
+	// encryption and decryption key have been updated by key update or DH
+	// rekey. Ratchet steps are not counted.
+	EncryptionKeyUpdates uint64
+	DecryptionKeyUpdates uint64
+
+	// DHRekeys is the number of DH rekeys whose secret has been mixed into the
+	// keys of both directions.
+	DHRekeys uint64
+
+	// LastDHRekey is the time when the last DH rekey completed, or zero if no DH
+	// rekey has completed.
+	LastDHRekey time.Time
+
+	// DHRekeyPending indicates a DH rekey started by local side is in progress.
+	DHRekeyPending bool
+}
+
+// rekeyState is the key update state of a stream that is shared by read and
+// write side, protected by rekeyLock.
+type rekeyState struct {
+	encryptionKeyUpdates uint64
+	decryptionKeyUpdates uint64
+	dhRekeys             uint64
+	lastDHRekey          time.Time
+
+	// dhRekeyStarted is the time when the last DH rekey started by local side
+	// started, or when the stream is created.
+	dhRekeyStarted time.Time
+
+	// privateKey is the ephemeral private key of the DH rekey started by local
+	// side, waiting for peer's response.
+	privateKey []byte
+
+	// sendSecret is the secret of the DH rekey started by local side, to be
+	// mixed into encryption key in the next Write.
+	sendSecret []byte
+
+	// responsePublicKey and responseSecret are the ephemeral public key and
+	// secret of the DH rekey started by peer, to be sent to peer and mixed into
+	// encryption key in the next Write.
+	responsePublicKey []byte
+	responseSecret    []byte
+
+	// receiveSecret is the secret of the DH rekey started by peer, to be mixed
+	// into decryption key when peer switches its encryption key.
+	receiveSecret []byte
+}
+
+// RekeyState returns the key update state of the stream.
+func (es *EncryptedStream) RekeyState() RekeyState {
+	es.rekeyLock.Lock()
+	defer es.rekeyLock.Unlock()
+
+	return RekeyState{
+		EncryptionKeyUpdates: es.rekey.encryptionKeyUpdates,
+		DecryptionKeyUpdates: es.rekey.decryptionKeyUpdates,
+		DHRekeys:             es.rekey.dhRekeys,
+		LastDHRekey:          es.rekey.lastDHRekey,
+		DHRekeyPending:       es.rekey.privateKey != nil || es.rekey.sendSecret != nil,
+	}
+}
+
+// DHRekey starts a DH rekey immediately instead of waiting for
+// Config.DHRekeyInterval. It requires Config.KeyUpdate to be true, and does
+// nothing if a DH rekey started by local side is in progress. The rekey
+// completes after both sides have written data.
+func (es *EncryptedStream) DHRekey() error {
+	if !es.config.KeyUpdate {
+		return errors.New("key update is not enabled")
+	}
+
+	err := es.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer es.unlockWrite()
+
+	return es.startDHRekey()
+}
+
+// maybeDHRekey sends the pending DH rekey response and key update, and starts a
+// new DH rekey if DHRekeyInterval has passed. Should be called with write lock
+// held.
+func (es *EncryptedStream) maybeDHRekey() error {
+	es.rekeyLock.Lock()
+	responsePublicKey, responseSecret := es.rekey.responsePublicKey, es.rekey.responseSecret
+	es.rekey.responsePublicKey, es.rekey.responseSecret = nil, nil
+	sendSecret := es.rekey.sendSecret
+	es.rekey.sendSecret = nil
+	start := es.config.DHRekeyInterval > 0 && es.rekey.privateKey == nil && time.Since(es.rekey.dhRekeyStarted) >= es.config.DHRekeyInterval
+	es.rekeyLock.Unlock()
+
+	if responsePublicKey != nil {
+		err := es.writeFrame(frameDHRekeyResponse, responsePublicKey)
+		if err != nil {
+			return err
+		}
+
+		err = es.switchEncryptionKey(responseSecret)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sendSecret != nil {
+		err := es.writeFrame(frameKeyUpdate, []byte{keyUpdateDHRekey})
+		if err != nil {
+			return err
+		}
+
+		err = es.switchEncryptionKey(sendSecret)
+		if err != nil {
+			return err
+		}
+
+		es.rekeyLock.Lock()
+		es.rekey.dhRekeys++
+		es.rekey.lastDHRekey = time.Now()
+		es.rekeyLock.Unlock()
+	}
+
+	if start {
+		return es.startDHRekey()
+	}
+
+	return nil
+}
+
+// startDHRekey sends a fresh ephemeral public key to peer. Should be called
+// with write lock held.
+func (es *EncryptedStream) startDHRekey() error {
+	privateKey, publicKey, err := generateX25519Key()
+	if err != nil {
+		return err
+	}
+
+	es.rekeyLock.Lock()
+	if es.rekey.privateKey != nil || es.rekey.sendSecret != nil {
+		es.rekeyLock.Unlock()
+		return nil
+	}
+	es.rekey.privateKey = privateKey
+	es.rekey.dhRekeyStarted = time.Now()
+	es.rekeyLock.Unlock()
+
+	return es.writeFrame(frameDHRekeyRequest, publicKey)
+}
+
+// handleDHRekeyRequest computes the DH rekey secret after receiving peer's
+// ephemeral public key. The response is sent in the next Write.
+func (es *EncryptedStream) handleDHRekeyRequest(peerPublicKey []byte) error {
+	if len(peerPublicKey) != curve25519.PointSize {
+		return errors.New("received invalid DH rekey request")
+	}
+
+	privateKey, publicKey, err := generateX25519Key()
+	if err != nil {
+		return err
+	}
+
+	secret, err := curve25519.X25519(privateKey, peerPublicKey)
+	erase(privateKey)
+	if err != nil {
+		return err
+	}
+
+	es.rekeyLock.Lock()
+	defer es.rekeyLock.Unlock()
+
+	if es.rekey.receiveSecret != nil {
+		return errors.New("received unexpected DH rekey request")
+	}
+
+	es.rekey.responsePublicKey = publicKey
+	es.rekey.responseSecret = secret
+	es.rekey.receiveSecret = secret
+
+	return nil
+}
+
+// handleDHRekeyResponse computes the DH rekey secret after receiving peer's
+// response, and switches the decryption key, as peer has switched its
+// encryption key after the response. The encryption key is switched in the next
+// Write.
+func (es *EncryptedStream) handleDHRekeyResponse(peerPublicKey []byte) error {
+	if len(peerPublicKey) != curve25519.PointSize {
+		return errors.New("received invalid DH rekey response")
+	}
+
+	es.rekeyLock.Lock()
+	privateKey := es.rekey.privateKey
+	if privateKey == nil {
+		es.rekeyLock.Unlock()
+		return errors.New("received unexpected DH rekey response")
+	}
+
+	secret, err := curve25519.X25519(privateKey, peerPublicKey)
+	erase(privateKey)
+	es.rekey.privateKey = nil
+	if err == nil {
+		es.rekey.sendSecret = secret
+	}
+	es.rekeyLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return es.switchDecryptionKey(secret)
+}
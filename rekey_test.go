@@ -0,0 +1,167 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+// send runs before (if not nil) and writes data on sender side, then reads data
+// on receiver side.
+func send(t *testing.T, from, to *EncryptedStream, data []byte, before func() error) {
+	errChan := make(chan error, 1)
+	go func() {
+		if before != nil {
+			err := before()
+			if err != nil {
+				errChan <- err
+				return
+			}
+		}
+		errChan <- write(from, data)
+	}()
+
+	err := read(to, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-errChan
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDHRekey(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted := keyUpdateStreamPair(t, cipher, Config{
+		MaxChunkSize:    1024,
+		KeyUpdate:       true,
+		DHRekeyInterval: time.Nanosecond,
+	})
+
+	// DH rekey completes after both sides have written.
+	data := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		send(t, aliceEncrypted, bobEncrypted, data, nil)
+		send(t, bobEncrypted, aliceEncrypted, data, nil)
+	}
+
+	for _, es := range []*EncryptedStream{aliceEncrypted, bobEncrypted} {
+		state := es.RekeyState()
+		if state.DHRekeys == 0 || state.LastDHRekey.IsZero() {
+			t.Fatalf("expect DH rekey to complete, got state %+v", state)
+		}
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDHRekeyRecovery(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Capture data sent by alice.
+	captured := &bytes.Buffer{}
+	aliceReader, bobWriter := io.Pipe()
+	bobReader, aliceWriter := io.Pipe()
+	alice := &readWriteCloser{Reader: aliceReader, Writer: io.MultiWriter(captured, aliceWriter), Closer: aliceWriter}
+	bob := &readWriteCloser{Reader: bobReader, Writer: bobWriter, Closer: bobWriter}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		newStream(Config{Cipher: cipher, Initiator: true, SequentialNonce: true, KeyUpdate: true}),
+		newStream(Config{Cipher: cipher, SequentialNonce: true, KeyUpdate: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := func() []byte {
+		b := make([]byte, 64)
+		_, err := rand.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	send(t, aliceEncrypted, bobEncrypted, random(), nil)
+
+	// Attacker steals alice's encryption key and nonce.
+	stolen, err := NewDecoder(aliceEncrypted.encoder.cipher, false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stolen.nextNonce = append([]byte(nil), aliceEncrypted.encoder.nextNonce...)
+	offset := captured.Len()
+
+	beforeKeyUpdate := random()
+	send(t, aliceEncrypted, bobEncrypted, beforeKeyUpdate, nil)
+
+	// Attacker can follow key update derived from the stolen key.
+	beforeDHRekey := random()
+	send(t, aliceEncrypted, bobEncrypted, beforeDHRekey, aliceEncrypted.UpdateKey)
+
+	send(t, aliceEncrypted, bobEncrypted, random(), aliceEncrypted.DHRekey)
+	send(t, bobEncrypted, aliceEncrypted, random(), nil)
+
+	if !aliceEncrypted.RekeyState().DHRekeyPending {
+		t.Fatal("DH rekey should be pending before alice switches key")
+	}
+
+	afterDHRekey := random()
+	send(t, aliceEncrypted, bobEncrypted, afterDHRekey, nil)
+
+	for _, es := range []*EncryptedStream{aliceEncrypted, bobEncrypted} {
+		state := es.RekeyState()
+		if state.DHRekeys != 1 || state.DHRekeyPending {
+			t.Fatalf("expect 1 completed DH rekey, got state %+v", state)
+		}
+	}
+
+	var recovered []byte
+	r := bytes.NewReader(captured.Bytes()[offset:])
+	buf := make([]byte, 1024)
+	for {
+		n, err := readVarBytes(r, buf, nil)
+		if err != nil {
+			break
+		}
+
+		plaintext, err := stolen.Decode(make([]byte, 1024), buf[:n])
+		if err != nil {
+			break
+		}
+
+		switch plaintext[0] {
+		case frameData:
+			recovered = append(recovered, plaintext[frameTypeSize:]...)
+		case frameKeyUpdate:
+			err = stolen.UpdateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if !bytes.Contains(recovered, beforeKeyUpdate) || !bytes.Contains(recovered, beforeDHRekey) {
+		t.Fatal("attacker should decrypt data before DH rekey with stolen key")
+	}
+
+	if bytes.Contains(recovered, afterDHRekey) {
+		t.Fatal("attacker should not decrypt data after DH rekey")
+	}
+}
@@ -0,0 +1,373 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// UnauthorizedKeyError is returned when peer's public key is not in the
+// allowlist (e.g. AuthorizedKeys), or is revoked.
+type UnauthorizedKeyError struct {
+	// Fingerprint is the OpenSSH SHA256 fingerprint of peer's public key.
+	Fingerprint string
+}
+
+func (e *UnauthorizedKeyError) Error() string {
+	return fmt.Sprintf("peer key %s is not authorized", e.Fingerprint)
+}
+
+// HostKeyMismatchError is returned by KnownHosts when peer's public key is
+// different from the key previously recorded for the same host, which may
+// indicate a man-in-the-middle attack.
+type HostKeyMismatchError struct {
+	// Host is the normalized host name.
+	Host string
+
+	// Fingerprint is the OpenSSH SHA256 fingerprint of peer's public key.
+	Fingerprint string
+
+	// KnownFingerprint is the OpenSSH SHA256 fingerprint of the recorded key.
+	KnownFingerprint string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("peer key %s of host %s does not match known key %s", e.Fingerprint, e.Host, e.KnownFingerprint)
+}
+
+// fingerprint returns the OpenSSH SHA256 fingerprint of an Ed25519 public key.
+func fingerprint(publicKey ed25519.PublicKey) string {
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return fmt.Sprintf("%x", []byte(publicKey))
+	}
+	return ssh.FingerprintSHA256(sshPublicKey)
+}
+
+// ed25519FromSSH returns the Ed25519 public key of an SSH public key, or nil if
+// it is not an Ed25519 key.
+func ed25519FromSSH(sshPublicKey ssh.PublicKey) ed25519.PublicKey {
+	if sshPublicKey.Type() != ssh.KeyAlgoED25519 {
+		return nil
+	}
+	cryptoPublicKey, ok := sshPublicKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil
+	}
+	publicKey, _ := cryptoPublicKey.CryptoPublicKey().(ed25519.PublicKey)
+	return publicKey
+}
+
+// AuthorizedKeys is an allowlist of Ed25519 public keys in OpenSSH
+// authorized_keys format. Its VerifyPeerPublicKey method can be used as
+// HandshakeConfig.VerifyPeerPublicKey.
+type AuthorizedKeys struct {
+	keys map[string]string
+}
+
+// authorizedKeyOptions are the authorized_keys options that are accepted. They
+// only disable SSH features that encrypted stream does not have, so they are
+// always enforced.
+var authorizedKeyOptions = map[string]bool{
+	"restrict":            true,
+	"no-agent-forwarding": true,
+	"no-port-forwarding":  true,
+	"no-pty":              true,
+	"no-user-rc":          true,
+	"no-x11-forwarding":   true,
+}
+
+// ParseAuthorizedKeys parses OpenSSH authorized_keys data. Only ssh-ed25519
+// entries are added to the allowlist, other key types are ignored. Returns
+// error if an ssh-ed25519 entry has an option that can not be enforced (e.g.
+// from= or expiry-time=), so that the key is not authorized without the
+// restriction. Options that only disable SSH features (e.g. restrict, no-pty)
+// are accepted.
+func ParseAuthorizedKeys(data []byte) (*AuthorizedKeys, error) {
+	a := &AuthorizedKeys{keys: make(map[string]string)}
+
+	for len(bytes.TrimSpace(data)) > 0 {
+		sshPublicKey, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		publicKey := ed25519FromSSH(sshPublicKey)
+		if publicKey == nil {
+			continue
+		}
+
+		for _, option := range options {
+			name := strings.ToLower(strings.SplitN(option, "=", 2)[0])
+			if !authorizedKeyOptions[name] {
+				return nil, fmt.Errorf("unsupported option %q of authorized key %s", option, fingerprint(publicKey))
+			}
+		}
+
+		a.keys[string(publicKey)] = comment
+	}
+
+	return a, nil
+}
+
+// LoadAuthorizedKeys reads and parses an OpenSSH authorized_keys file. See
+// ParseAuthorizedKeys.
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuthorizedKeys(data)
+}
+
+// Len returns the number of authorized keys.
+func (a *AuthorizedKeys) Len() int {
+	return len(a.keys)
+}
+
+// Contains returns whether a public key is authorized.
+func (a *AuthorizedKeys) Contains(publicKey ed25519.PublicKey) bool {
+	_, ok := a.keys[string(publicKey)]
+	return ok
+}
+
+// VerifyPeerPublicKey returns *UnauthorizedKeyError if the public key is not
+// authorized.
+func (a *AuthorizedKeys) VerifyPeerPublicKey(publicKey ed25519.PublicKey) error {
+	if !a.Contains(publicKey) {
+		return &UnauthorizedKeyError{Fingerprint: fingerprint(publicKey)}
+	}
+	return nil
+}
+
+// knownHost is a known_hosts entry. publicKey is nil if the entry has another
+// key type or is a CA key, in which case the hosts are still known.
+type knownHost struct {
+	revoked     bool
+	hosts       []string
+	publicKey   ed25519.PublicKey
+	fingerprint string
+}
+
+// KnownHosts is a trust-on-first-use store of peers' Ed25519 public keys in
+// OpenSSH known_hosts format, used by initiator to authenticate responders. The
+// first time a host is seen, its key is recorded (and appended to the file if
+// loaded from a file), and later handshakes with the same host must present the
+// same key. It is safe for concurrent use.
+type KnownHosts struct {
+	path string
+
+	lock    sync.Mutex
+	entries []*knownHost
+}
+
+// ParseKnownHosts parses OpenSSH known_hosts data. Only ssh-ed25519 keys are
+// accepted, but hosts of entries with other key types or @cert-authority are
+// still known, so an Ed25519 key presented by them is rejected as a mismatch
+// instead of being recorded. Hashed host names are supported. New hosts will
+// only be recorded in memory.
+func ParseKnownHosts(data []byte) (*KnownHosts, error) {
+	k := &KnownHosts{}
+
+	for len(bytes.TrimSpace(data)) > 0 {
+		marker, hosts, sshPublicKey, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		var publicKey ed25519.PublicKey
+		if marker != "cert-authority" {
+			publicKey = ed25519FromSSH(sshPublicKey)
+		}
+
+		k.entries = append(k.entries, &knownHost{
+			revoked:     marker == "revoked",
+			hosts:       hosts,
+			publicKey:   publicKey,
+			fingerprint: ssh.FingerprintSHA256(sshPublicKey),
+		})
+	}
+
+	return k, nil
+}
+
+// LoadKnownHosts reads and parses an OpenSSH known_hosts file. A missing file
+// is treated as empty. New hosts will be appended to the file.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	k, err := ParseKnownHosts(data)
+	if err != nil {
+		return nil, err
+	}
+
+	k.path = path
+
+	return k, nil
+}
+
+// VerifyPeerPublicKey returns a function that can be used as
+// HandshakeConfig.VerifyPeerPublicKey when connecting to host (an address in
+// the form of "host" or "host:port"). It records the key if host is not known,
+// returns *HostKeyMismatchError if host is known with a different key (of any
+// type), and returns *UnauthorizedKeyError if the key is revoked. Host names
+// are case insensitive as in OpenSSH.
+func (k *KnownHosts) VerifyPeerPublicKey(host string) func(ed25519.PublicKey) error {
+	host = strings.ToLower(knownhosts.Normalize(host))
+	return func(publicKey ed25519.PublicKey) error {
+		return k.verify(host, publicKey)
+	}
+}
+
+func (k *KnownHosts) verify(host string, publicKey ed25519.PublicKey) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	var knownFingerprint string
+	for _, entry := range k.entries {
+		if entry.revoked {
+			if entry.publicKey.Equal(publicKey) {
+				return &UnauthorizedKeyError{Fingerprint: fingerprint(publicKey)}
+			}
+			continue
+		}
+
+		if !entry.matchHost(host) {
+			continue
+		}
+
+		if entry.publicKey.Equal(publicKey) {
+			return nil
+		}
+		knownFingerprint = entry.fingerprint
+	}
+
+	if knownFingerprint != "" {
+		return &HostKeyMismatchError{
+			Host:             host,
+			Fingerprint:      fingerprint(publicKey),
+			KnownFingerprint: knownFingerprint,
+		}
+	}
+
+	return k.add(host, publicKey)
+}
+
+// add records a new host key, and appends it to the file if there is one.
+func (k *KnownHosts) add(host string, publicKey ed25519.PublicKey) error {
+	if k.path != "" {
+		sshPublicKey, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.WriteString(knownhosts.Line([]string{host}, sshPublicKey) + "\n")
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	k.entries = append(k.entries, &knownHost{hosts: []string{host}, publicKey: publicKey, fingerprint: fingerprint(publicKey)})
+
+	return nil
+}
+
+// matchHost returns whether the entry matches a normalized lowercase host
+// name. As in OpenSSH, host patterns are case insensitive and may contain
+// wildcards (* and ?), and the entry does not match if host matches any negated
+// pattern (prefixed by !).
+func (entry *knownHost) matchHost(host string) bool {
+	matched := false
+	for _, pattern := range entry.hosts {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+
+		if !matchWildcard(strings.ToLower(pattern), host) && !matchHashedHost(pattern, host) {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchWildcard returns whether s matches pattern, where * matches any
+// sequence of characters and ? matches any single character.
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchHashedHost returns whether a hashed known_hosts host name
+// (|1|base64(salt)|base64(hmac-sha1(salt, host))) matches host.
+func matchHashedHost(hashed, host string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "1" {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
@@ -0,0 +1,366 @@
+package stream
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func marshalSSHPublicKey(t *testing.T, publicKey interface{}) ssh.PublicKey {
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPublicKey
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	alicePub, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eveKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "# comment\n"
+	data += string(ssh.MarshalAuthorizedKey(marshalSSHPublicKey(t, &eveKey.PublicKey)))
+	data += "no-pty " + string(ssh.MarshalAuthorizedKey(marshalSSHPublicKey(t, alicePub)))
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	err = os.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizedKeys, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authorizedKeys.Len() != 1 {
+		t.Fatalf("expect 1 authorized key, got %d", authorizedKeys.Len())
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, PrivateKey: aliceKey}),
+		handshake(HandshakeConfig{PrivateKey: bobKey, VerifyPeerPublicKey: authorizedKeys.VerifyPeerPublicKey}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorizedKeysReject(t *testing.T) {
+	alicePub, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPub, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizedKeys, err := ParseAuthorizedKeys(ssh.MarshalAuthorizedKey(marshalSSHPublicKey(t, bobPub)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := net.Pipe()
+
+	bobChan := make(chan error, 1)
+	go func() {
+		_, err := Handshake(bob, &HandshakeConfig{PrivateKey: bobKey, VerifyPeerPublicKey: authorizedKeys.VerifyPeerPublicKey})
+		bob.Close()
+		bobChan <- err
+	}()
+
+	Handshake(alice, &HandshakeConfig{Initiator: true, PrivateKey: aliceKey})
+	alice.Close()
+
+	var unauthorizedErr *UnauthorizedKeyError
+	if err := <-bobChan; !errors.As(err, &unauthorizedErr) {
+		t.Fatalf("expect *UnauthorizedKeyError, got %v", err)
+	}
+
+	if expected := ssh.FingerprintSHA256(marshalSSHPublicKey(t, alicePub)); unauthorizedErr.Fingerprint != expected {
+		t.Fatalf("expect fingerprint %s, got %s", expected, unauthorizedErr.Fingerprint)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	bobPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	knownHosts, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := knownHosts.VerifyPeerPublicKey("example.com:1234")
+
+	// Trust on first use.
+	err = verify(bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verify(bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	knownHosts, err = LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = knownHosts.VerifyPeerPublicKey("example.com:1234")(bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mismatchErr *HostKeyMismatchError
+	err = knownHosts.VerifyPeerPublicKey("example.com:1234")(evePub)
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expect *HostKeyMismatchError, got %v", err)
+	}
+
+	if expected := ssh.FingerprintSHA256(marshalSSHPublicKey(t, evePub)); mismatchErr.Fingerprint != expected {
+		t.Fatalf("expect fingerprint %s, got %s", expected, mismatchErr.Fingerprint)
+	}
+
+	err = knownHosts.VerifyPeerPublicKey("example.org:1234")(evePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKnownHostsHashedAndRevoked(t *testing.T) {
+	bobPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := knownhosts.Line([]string{knownhosts.HashHostname("example.com")}, marshalSSHPublicKey(t, bobPub)) + "\n"
+	data += "@revoked * " + string(ssh.MarshalAuthorizedKey(marshalSSHPublicKey(t, evePub)))
+
+	knownHosts, err := ParseKnownHosts([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = knownHosts.VerifyPeerPublicKey("example.com")(bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoked key is rejected for any host.
+	for _, host := range []string{"example.com:22", "example.org"} {
+		var unauthorizedErr *UnauthorizedKeyError
+		err = knownHosts.VerifyPeerPublicKey(host)(evePub)
+		if !errors.As(err, &unauthorizedErr) {
+			t.Fatalf("expect *UnauthorizedKeyError, got %v", err)
+		}
+	}
+}
+
+func TestAuthorizedKeysOptions(t *testing.T) {
+	alicePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := string(ssh.MarshalAuthorizedKey(marshalSSHPublicKey(t, alicePub)))
+
+	authorizedKeys, err := ParseAuthorizedKeys([]byte("restrict,no-pty " + line))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !authorizedKeys.Contains(alicePub) {
+		t.Fatal("key with restrictive options should be authorized")
+	}
+
+	for _, options := range []string{`from="10.0.0.1"`, `expiry-time="20200101"`, `restrict,command="true"`} {
+		_, err = ParseAuthorizedKeys([]byte(options + " " + line))
+		if err == nil {
+			t.Fatalf("key with options %s should be rejected", options)
+		}
+	}
+}
+
+func TestKnownHostsPatterns(t *testing.T) {
+	bobPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := knownhosts.Line([]string{"*.example.com", "!evil.example.com", "host?.example.org"}, marshalSSHPublicKey(t, bobPub)) + "\n"
+
+	knownHosts, err := ParseKnownHosts([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"a.example.com", "host1.example.org"} {
+		err = knownHosts.VerifyPeerPublicKey(host)(bobPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mismatchErr *HostKeyMismatchError
+		err = knownHosts.VerifyPeerPublicKey(host)(evePub)
+		if !errors.As(err, &mismatchErr) {
+			t.Fatalf("expect *HostKeyMismatchError for host %s, got %v", host, err)
+		}
+	}
+
+	// Negated and unmatched hosts are unknown and recorded on first use.
+	for _, host := range []string{"evil.example.com", "host10.example.org"} {
+		err = knownHosts.VerifyPeerPublicKey(host)(evePub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "example.org", false},
+		{"*", "", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"[host?]:*", "[host1]:2222", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"?", "", false},
+	}
+
+	for _, test := range tests {
+		if matched := matchWildcard(test.pattern, test.s); matched != test.expected {
+			t.Fatalf("match %q with pattern %q: expect %v, got %v", test.s, test.pattern, test.expected, matched)
+		}
+	}
+}
+
+func TestKnownHostsCaseInsensitive(t *testing.T) {
+	bobPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := knownhosts.Line([]string{"example.com", "*.Example.org"}, marshalSSHPublicKey(t, bobPub)) + "\n"
+
+	knownHosts, err := ParseKnownHosts([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"Example.com", "EXAMPLE.COM:22", "a.example.ORG"} {
+		err = knownHosts.VerifyPeerPublicKey(host)(bobPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mismatchErr *HostKeyMismatchError
+		err = knownHosts.VerifyPeerPublicKey(host)(evePub)
+		if !errors.As(err, &mismatchErr) {
+			t.Fatalf("expect *HostKeyMismatchError for host %s, got %v", host, err)
+		}
+	}
+}
+
+func TestKnownHostsOtherKeyType(t *testing.T) {
+	bobKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobSSHPublicKey := marshalSSHPublicKey(t, &bobKey.PublicKey)
+	data := knownhosts.Line([]string{"example.com"}, bobSSHPublicKey) + "\n"
+	data += "@cert-authority *.example.org " + string(ssh.MarshalAuthorizedKey(bobSSHPublicKey))
+
+	knownHosts, err := ParseKnownHosts([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hosts pinned with other key types are known, so an Ed25519 key is not
+	// recorded on first use.
+	for _, host := range []string{"example.com", "a.example.org"} {
+		for i := 0; i < 2; i++ {
+			var mismatchErr *HostKeyMismatchError
+			err = knownHosts.VerifyPeerPublicKey(host)(evePub)
+			if !errors.As(err, &mismatchErr) {
+				t.Fatalf("expect *HostKeyMismatchError for host %s, got %v", host, err)
+			}
+
+			if mismatchErr.KnownFingerprint != ssh.FingerprintSHA256(bobSSHPublicKey) {
+				t.Fatalf("expect known fingerprint %s, got %s", ssh.FingerprintSHA256(bobSSHPublicKey), mismatchErr.KnownFingerprint)
+			}
+		}
+	}
+}
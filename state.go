@@ -0,0 +1,273 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	// stateVersion is the version of marshaled nonce state.
+	stateVersion = 1
+
+	// stateHeaderSize is the size of version, type, initiator and nonce size
+	// before the nonce in marshaled Encoder or Decoder state.
+	stateHeaderSize = 4
+)
+
+const (
+	stateTypeEncoder byte = iota + 1
+	stateTypeDecoder
+	stateTypeStream
+)
+
+// ErrStateLeaseExpired indicates Encoder has used all nonces leased by the last
+// MarshalState (or none are leased after UnmarshalState). MarshalState should
+// be called and its output persisted to lease more nonces.
+var ErrStateLeaseExpired = errors.New("nonce state lease expired")
+
+// MarshalState returns the nonce state of Encoder with sequential nonce, so that
+// a stream can be resumed with the same key by UnmarshalState after the process
+// restarts. To prevent a stale snapshot from reusing nonces, the next lease
+// nonces are reserved: the snapshot resumes after them, and Encode returns
+// ErrStateLeaseExpired once they are used until MarshalState is called again.
+// The output should be persisted durably before encoding with the leased
+// nonces. Lease of zero stops Encoder at the current nonce, e.g. on graceful
+// shutdown. State can not be marshaled once the key is updated by ratchet or
+// key update, as the key to resume with is no longer known to the caller.
+func (e *Encoder) MarshalState(lease uint64) ([]byte, error) {
+	if e.cipher == nil || !e.sequentialNonce {
+		return nil, errors.New("nonce state is only available with sequential nonce")
+	}
+
+	if e.ratchetInterval > 0 || e.keyUpdated {
+		return nil, errors.New("nonce state is not available when key is updated")
+	}
+
+	e.leaseEnd = addNonce(e.nextNonce, lease, e.maxNonce)
+
+	return marshalNonceState(stateTypeEncoder, e.initiator, e.leaseEnd), nil
+}
+
+// UnmarshalState restores the nonce state marshaled by MarshalState of an
+// Encoder with the same key, initiator and sequential nonce. No nonce is
+// leased afterwards, so MarshalState should be called and its output persisted
+// before Encode, otherwise restoring the same state again would reuse nonces.
+// It should not be called concurrently with Encode.
+func (e *Encoder) UnmarshalState(data []byte) error {
+	if e.cipher == nil || !e.sequentialNonce {
+		return errors.New("nonce state is only available with sequential nonce")
+	}
+
+	if e.ratchetInterval > 0 || e.keyUpdated {
+		return errors.New("nonce state is not available when key is updated")
+	}
+
+	nonce, err := unmarshalNonceState(data, stateTypeEncoder, e.initiator, e.cipher.NonceSize())
+	if err != nil {
+		return err
+	}
+
+	if nonce[0]>>7 != e.nextNonce[0]>>7 || bytes.Compare(nonce, e.maxNonce) > 0 {
+		return errors.New("invalid nonce in state")
+	}
+
+	e.nextNonce = nonce
+	e.leaseEnd = append([]byte(nil), nonce...)
+
+	return nil
+}
+
+// MarshalState returns the nonce state of Decoder with sequential nonce. See
+// Encoder.MarshalState. Decoder state does not need a lease: after
+// UnmarshalState, Decoder accepts the first chunk with a nonce not less than
+// the restored one, as the peer may resume after its leased nonces. A stale
+// snapshot can not reuse nonces, but may accept chunks received after it was
+// taken if they are replayed, so it should be persisted together with the data
+// read from the stream. It is safe to call MarshalState concurrently with
+// Decode.
+func (d *Decoder) MarshalState() ([]byte, error) {
+	if d.cipher == nil || !d.sequentialNonce {
+		return nil, errors.New("nonce state is only available with sequential nonce")
+	}
+
+	if d.ratchetInterval > 0 || d.keyUpdated {
+		return nil, errors.New("nonce state is not available when key is updated")
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	return marshalNonceState(stateTypeDecoder, d.initiator, d.nextNonce), nil
+}
+
+// UnmarshalState restores the nonce state marshaled by MarshalState of a
+// Decoder with the same key, initiator and sequential nonce. It should not be
+// called concurrently with Decode.
+func (d *Decoder) UnmarshalState(data []byte) error {
+	if d.cipher == nil || !d.sequentialNonce {
+		return errors.New("nonce state is only available with sequential nonce")
+	}
+
+	if d.ratchetInterval > 0 || d.keyUpdated {
+		return errors.New("nonce state is not available when key is updated")
+	}
+
+	nonce, err := unmarshalNonceState(data, stateTypeDecoder, d.initiator, d.cipher.NonceSize())
+	if err != nil {
+		return err
+	}
+
+	if nonce[0]>>7 != d.nextNonce[0]>>7 {
+		return errors.New("invalid nonce in state")
+	}
+
+	d.stateLock.Lock()
+	d.nextNonce = nonce
+	d.resync = true
+	d.stateLock.Unlock()
+
+	return nil
+}
+
+// MarshalState returns the nonce state of both directions of a stream with
+// sequential nonce, leasing the next lease nonces for writing (see
+// Encoder.MarshalState). It can be restored by UnmarshalState of a stream
+// created with the same config after the process restarts. Returns
+// ErrStateLeaseExpired from Write once the leased nonces are used. It does not
+// block on pending Read, and is not available with key update, ratchet,
+// Config.EncryptLength or Config.Preamble, as preamble confirmation is
+// encrypted when the stream is created, before the state can be restored.
+func (es *EncryptedStream) MarshalState(lease uint64) ([]byte, error) {
+	if es.config.KeyUpdate {
+		return nil, errors.New("nonce state is not available when key is updated")
+	}
+
+	if es.config.EncryptLength {
+		return nil, errors.New("nonce state is not available when length is encrypted")
+	}
+
+	if es.config.Preamble {
+		return nil, errors.New("nonce state is not available with preamble")
+	}
+
+	err := es.lockWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer es.unlockWrite()
+
+	encoderState, err := es.encoder.MarshalState(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	decoderState, err := es.decoder.MarshalState()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, 2+len(encoderState)+len(decoderState))
+	b = append(b, stateVersion, stateTypeStream)
+	b = append(b, encoderState...)
+	b = append(b, decoderState...)
+
+	return b, nil
+}
+
+// UnmarshalState restores the nonce state marshaled by MarshalState of a stream
+// created with the same config. It should be called before the first Read and
+// Write, and MarshalState should be called and its output persisted before
+// writing.
+func (es *EncryptedStream) UnmarshalState(data []byte) error {
+	if es.config.KeyUpdate {
+		return errors.New("nonce state is not available when key is updated")
+	}
+
+	if es.config.EncryptLength {
+		return errors.New("nonce state is not available when length is encrypted")
+	}
+
+	if es.config.Preamble {
+		return errors.New("nonce state is not available with preamble")
+	}
+
+	if len(data) < 2 || data[0] != stateVersion || data[1] != stateTypeStream {
+		return errors.New("invalid stream state")
+	}
+	data = data[2:]
+
+	if len(data) < stateHeaderSize {
+		return errors.New("invalid stream state")
+	}
+	encoderStateSize := stateHeaderSize + int(data[3])
+	if len(data) < encoderStateSize {
+		return errors.New("invalid stream state")
+	}
+
+	err := es.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer es.unlockWrite()
+
+	err = es.lockRead()
+	if err != nil {
+		return err
+	}
+	defer es.unlockRead()
+
+	err = es.encoder.UnmarshalState(data[:encoderStateSize])
+	if err != nil {
+		return err
+	}
+
+	return es.decoder.UnmarshalState(data[encoderStateSize:])
+}
+
+// marshalNonceState encodes the nonce state of Encoder or Decoder.
+func marshalNonceState(stateType byte, initiator bool, nonce []byte) []byte {
+	b := make([]byte, stateHeaderSize, stateHeaderSize+len(nonce))
+	b[0] = stateVersion
+	b[1] = stateType
+	if initiator {
+		b[2] = 1
+	}
+	b[3] = byte(len(nonce))
+	return append(b, nonce...)
+}
+
+// unmarshalNonceState decodes the nonce state of Encoder or Decoder and
+// verifies it matches the given type, initiator and nonce size.
+func unmarshalNonceState(data []byte, stateType byte, initiator bool, nonceSize int) ([]byte, error) {
+	if len(data) < stateHeaderSize || data[0] != stateVersion || data[1] != stateType {
+		return nil, errors.New("invalid nonce state")
+	}
+
+	if (data[2] == 1) != initiator {
+		return nil, errors.New("nonce state initiator mismatch")
+	}
+
+	if int(data[3]) != nonceSize || len(data) != stateHeaderSize+nonceSize {
+		return nil, fmt.Errorf("invalid nonce state size %d", len(data))
+	}
+
+	return append([]byte(nil), data[stateHeaderSize:]...), nil
+}
+
+// addNonce returns nonce incremented by n, or max if it exceeds max.
+func addNonce(nonce []byte, n uint64, max []byte) []byte {
+	b := append([]byte(nil), nonce...)
+	carry := n
+	for i := len(b) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(b[i]) + carry&0xff
+		b[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	if carry > 0 || bytes.Compare(b, max) > 0 {
+		return append([]byte(nil), max...)
+	}
+
+	return b
+}
@@ -0,0 +1,260 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNonceState(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoder, err := NewEncoder(cipher, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err := NewDecoder(cipher, false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(e *Encoder) ([]byte, error) {
+		return e.Encode(make([]byte, 128), []byte("hello"))
+	}
+
+	var chunks [][]byte
+	for i := 0; i < 3; i++ {
+		chunk, err := encode(encoder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	encoderState, err := encoder.MarshalState(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		chunk, err := encode(encoder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	_, err = encode(encoder)
+	if err != ErrStateLeaseExpired {
+		t.Fatalf("expect ErrStateLeaseExpired, got %v", err)
+	}
+
+	for _, chunk := range chunks[:3] {
+		_, err = decoder.Decode(make([]byte, 128), chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decoderState, err := decoder.MarshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart both sides with the same key.
+	resumedEncoder, err := NewEncoder(cipher, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resumedEncoder.UnmarshalState(encoderState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = encode(resumedEncoder)
+	if err != ErrStateLeaseExpired {
+		t.Fatalf("expect ErrStateLeaseExpired before lease, got %v", err)
+	}
+
+	_, err = resumedEncoder.MarshalState(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumedDecoder, err := NewDecoder(cipher, false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resumedDecoder.UnmarshalState(decoderState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonceSize := cipher.NonceSize()
+	for i := 0; i < 2; i++ {
+		chunk, err := encode(resumedEncoder)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, used := range chunks {
+			if bytes.Compare(chunk[:nonceSize], used[:nonceSize]) <= 0 {
+				t.Fatal("resumed encoder should not reuse nonce")
+			}
+		}
+
+		_, err = resumedDecoder.Decode(make([]byte, 128), chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = resumedDecoder.Decode(make([]byte, 128), chunks[3])
+	if err != ErrWrongNonceSequential {
+		t.Fatalf("expect ErrWrongNonceSequential for replayed chunk, got %v", err)
+	}
+
+	err = resumedDecoder.UnmarshalState(encoderState)
+	if err == nil {
+		t.Fatal("decoder should not accept encoder state")
+	}
+
+	randomEncoder, err := NewEncoder(cipher, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = randomEncoder.MarshalState(1)
+	if err == nil {
+		t.Fatal("state should not be available with random nonce")
+	}
+}
+
+func TestStreamState(t *testing.T) {
+	cipher, err := NewAESGCMCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceConfig := &Config{Cipher: cipher, Initiator: true, SequentialNonce: true}
+	bobConfig := &Config{Cipher: cipher, SequentialNonce: true}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, err := NewEncryptedStream(alice, aliceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobEncrypted, err := NewEncryptedStream(bob, bobConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var aliceState, bobState []byte
+	for _, es := range []*EncryptedStream{aliceEncrypted, bobEncrypted} {
+		state, err := es.MarshalState(1 << 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if es == aliceEncrypted {
+			aliceState = state
+		} else {
+			bobState = state
+		}
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err = createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, err = NewEncryptedStream(alice, aliceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobEncrypted, err = NewEncryptedStream(bob, bobConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = aliceEncrypted.UnmarshalState(bobState)
+	if err == nil {
+		t.Fatal("state of the other side should not be accepted")
+	}
+
+	for _, es := range []*EncryptedStream{aliceEncrypted, bobEncrypted} {
+		state := aliceState
+		if es == bobEncrypted {
+			state = bobState
+		}
+
+		err = es.UnmarshalState(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = es.Write([]byte("hello"))
+		if err != ErrStateLeaseExpired {
+			t.Fatalf("expect ErrStateLeaseExpired, got %v", err)
+		}
+
+		_, err = es.MarshalState(1 << 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamStatePreamble(t *testing.T) {
+	cipher, err := NewAESGCMCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Preamble confirmation is encrypted with the first nonce when the stream
+	// is created, so restoring state would reuse it.
+	aliceEncrypted, _, err := handshakePair(
+		alice,
+		bob,
+		newStream(Config{Cipher: cipher, Initiator: true, SequentialNonce: true, Preamble: true}),
+		newStream(Config{Cipher: cipher, SequentialNonce: true, Preamble: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = aliceEncrypted.MarshalState(1 << 20)
+	if err == nil {
+		t.Fatal("state should not be marshaled with preamble")
+	}
+
+	err = aliceEncrypted.UnmarshalState(marshalNonceState(stateTypeStream, true, nil))
+	if err == nil {
+		t.Fatal("state should not be unmarshaled with preamble")
+	}
+}
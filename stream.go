@@ -1,10 +1,12 @@
 package stream
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,26 +15,58 @@ import (
 type EncryptedStream struct {
 	config  *Config
 	stream  io.ReadWriter
+	reader  io.Reader
 	encoder *Encoder
 	decoder *Decoder
 
+	protocolVersion uint8
+
 	lock     sync.RWMutex
 	isClosed bool
 
-	readLock        sync.Mutex
-	readLenBuffer   []byte
-	readBuffer      []byte
-	decryptBuffer   []byte
-	decryptBufStart int
-	decryptBufEnd   int
-
-	writeLock      sync.Mutex
-	writeLenBuffer []byte
-	encryptBuffer  []byte
+	readLock         sync.Mutex
+	readLenBuffer    []byte
+	readLengthCipher *lengthCipher
+	readBuffer       []byte
+	decryptBuffer    []byte
+	decryptBufStart  int
+	decryptBufEnd    int
+	readDestroyed    bool
+
+	writeLock         sync.Mutex
+	writeLenBuffer    []byte
+	writeLengthCipher *lengthCipher
+	frameBuffer       []byte
+	encryptBuffer     []byte
+	writeDestroyed    bool
+
+	destroyLock    sync.Mutex
+	destroyedSides int
+	sharedCiphers  []Cipher
+
+	keyUpdateChunks    uint64
+	keyUpdateBytes     uint64
+	keyUpdateTime      time.Time
+	keyUpdateRequested atomic.Bool
+
+	rekeyLock sync.Mutex
+	rekey     rekeyState
+
+	peerStaticKey  []byte
+	peerPublicKey  ed25519.PublicKey
+	peerAttributes map[string]string
+	earlyData      []byte
+	resumed        bool
+	sessionTicket  []byte
+	cipherSuite    CipherSuite
+
+	exporterSecret []byte
+	transcriptHash []byte
 }
 
 // NewEncryptedStream creates an EncryptedStream with a given ReadWriter and
-// config.
+// config. If config.Preamble is true, preamble will be exchanged before
+// returning.
 func NewEncryptedStream(stream io.ReadWriter, config *Config) (*EncryptedStream, error) {
 	config, err := MergeConfig(DefaultConfig(), config)
 	if err != nil {
@@ -54,18 +88,66 @@ func NewEncryptedStream(stream io.ReadWriter, config *Config) (*EncryptedStream,
 		return nil, err
 	}
 
+	encoder.SetRatchetInterval(config.RatchetInterval)
+	decoder.SetRatchetInterval(config.RatchetInterval)
+
+	if config.KeyIDs {
+		encoder.EnableKeyID(config.KeyID)
+		decoder.EnableKeyID(config.KeyID)
+	}
+
+	if config.AuthenticateHeader || config.EncryptLength {
+		err = encoder.EnableHeaderAuthentication()
+		if err != nil {
+			return nil, err
+		}
+
+		err = decoder.EnableHeaderAuthentication()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	es := &EncryptedStream{
 		config:         config,
 		stream:         stream,
+		reader:         stream,
 		encoder:        encoder,
 		decoder:        decoder,
-		readBuffer:     make([]byte, config.MaxChunkSize+config.Cipher.MaxOverhead()+config.Cipher.NonceSize()),
-		encryptBuffer:  make([]byte, config.MaxChunkSize+config.Cipher.MaxOverhead()+config.Cipher.NonceSize()),
-		decryptBuffer:  make([]byte, config.MaxChunkSize),
+		readBuffer:     make([]byte, config.maxEncryptedChunkSize()),
+		encryptBuffer:  make([]byte, config.maxEncryptedChunkSize()),
+		decryptBuffer:  make([]byte, config.MaxChunkSize+config.frameHeaderSize()),
 		readLenBuffer:  make([]byte, 4),
 		writeLenBuffer: make([]byte, 4),
 	}
 
+	if config.EncryptLength {
+		config.LengthKey = append([]byte(nil), config.LengthKey...)
+
+		es.writeLengthCipher, err = newLengthCipher(config.LengthKey, config.Initiator)
+		if err != nil {
+			return nil, err
+		}
+
+		es.readLengthCipher, err = newLengthCipher(config.LengthKey, !config.Initiator)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.KeyUpdate {
+		es.frameBuffer = make([]byte, config.MaxChunkSize+frameTypeSize)
+		es.keyUpdateTime = time.Now()
+		es.rekey.dhRekeyStarted = es.keyUpdateTime
+	}
+
+	if config.Preamble {
+		err = es.exchangePreamble()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return es, nil
 }
 
@@ -78,31 +160,50 @@ func (es *EncryptedStream) IsClosed() bool {
 
 // Read implements net.Conn and io.Reader
 func (es *EncryptedStream) Read(b []byte) (int, error) {
-	if es.IsClosed() {
-		return 0, io.ErrClosedPipe
+	err := es.lockRead()
+	if err != nil {
+		return 0, err
 	}
+	defer es.unlockRead()
 
-	es.readLock.Lock()
-	defer es.readLock.Unlock()
+	if len(es.earlyData) > 0 {
+		n := copy(b, es.earlyData)
+		erase(es.earlyData[:n])
+		es.earlyData = es.earlyData[n:]
+		return n, nil
+	}
 
-	if es.decryptBufStart >= es.decryptBufEnd {
-		n, err := readVarBytes(es.stream, es.readBuffer, es.readLenBuffer)
+	for es.decryptBufStart >= es.decryptBufEnd {
+		n, err := es.readChunk()
 		if err != nil {
 			return 0, err
 		}
 
-		if n > es.config.MaxChunkSize+es.config.Cipher.MaxOverhead()+es.config.Cipher.NonceSize() {
+		if n > es.config.maxEncryptedChunkSize() {
 			return 0, fmt.Errorf("received invalid encrypted data size %d", n)
 		}
 
-		es.decryptBuffer = es.decryptBuffer[:cap(es.decryptBuffer)]
-		es.decryptBuffer, err = es.decoder.Decode(es.decryptBuffer, es.readBuffer[:n])
+		plaintext, err := es.decoder.Decode(es.decryptBuffer[:cap(es.decryptBuffer)], es.readBuffer[:n])
 		if err != nil {
 			return 0, err
 		}
+		es.decryptBuffer = plaintext
 
 		es.decryptBufStart = 0
 		es.decryptBufEnd = len(es.decryptBuffer)
+
+		if !es.config.KeyUpdate {
+			break
+		}
+
+		isData, err := es.handleFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		if isData {
+			break
+		}
 	}
 
 	n := copy(b, es.decryptBuffer[es.decryptBufStart:es.decryptBufEnd])
@@ -113,55 +214,140 @@ func (es *EncryptedStream) Read(b []byte) (int, error) {
 
 // Write implements net.Conn and io.Writer
 func (es *EncryptedStream) Write(b []byte) (int, error) {
-	if es.IsClosed() {
-		return 0, io.ErrClosedPipe
+	err := es.lockWrite()
+	if err != nil {
+		return 0, err
 	}
-
-	es.writeLock.Lock()
-	defer es.writeLock.Unlock()
+	defer es.unlockWrite()
 
 	bytesWrite := 0
-	var err error
 	for bytesWrite < len(b) {
 		n := len(b) - bytesWrite
 		if n > es.config.MaxChunkSize {
 			n = es.config.MaxChunkSize
 		}
 
-		es.encryptBuffer = es.encryptBuffer[:cap(es.encryptBuffer)]
-		es.encryptBuffer, err = es.encoder.Encode(es.encryptBuffer, b[bytesWrite:bytesWrite+n])
-		if err != nil {
-			return bytesWrite, err
+		if es.config.KeyUpdate {
+			err = es.maybeUpdateKey(n)
+			if err != nil {
+				return bytesWrite, err
+			}
 		}
 
-		err = writeVarBytes(es.stream, es.encryptBuffer, es.writeLenBuffer)
+		err = es.writeFrame(frameData, b[bytesWrite:bytesWrite+n])
 		if err != nil {
 			return bytesWrite, err
 		}
 
+		if es.config.KeyUpdate {
+			es.keyUpdateChunks++
+			es.keyUpdateBytes += uint64(n)
+		}
+
 		bytesWrite += n
 	}
 
 	return bytesWrite, nil
 }
 
+// writeFrame encrypts and writes a chunk. Frame type is only written when
+// control frames are enabled, in which case frame type should be frameData
+// when writing data. Should be called with write lock held.
+func (es *EncryptedStream) writeFrame(frameType byte, data []byte) error {
+	plaintext := data
+	if es.config.KeyUpdate {
+		es.frameBuffer = es.frameBuffer[:frameTypeSize+len(data)]
+		es.frameBuffer[0] = frameType
+		copy(es.frameBuffer[frameTypeSize:], data)
+		plaintext = es.frameBuffer
+	}
+
+	encrypted, err := es.encoder.Encode(es.encryptBuffer[:cap(es.encryptBuffer)], plaintext)
+	if err != nil {
+		return err
+	}
+	es.encryptBuffer = encrypted
+
+	return es.writeChunk(es.encryptBuffer)
+}
+
 // Close implements net.Conn and io.Closer. Will call underlying stream's
-// Close() method if it has one.
+// Close() method if it has one. Key material and plaintext held by the stream
+// are erased: ciphers owned by the stream (and Config.Cipher if
+// Config.DestroyCipher is true) are destroyed (see Destroyer), and decrypted
+// data not yet read are discarded. A pending Read or Write erases its side when
+// it returns, so Close does not block on it.
 func (es *EncryptedStream) Close() error {
 	es.lock.Lock()
-	defer es.lock.Unlock()
-
 	if es.isClosed {
+		es.lock.Unlock()
 		return nil
 	}
+	es.isClosed = true
+	erase(es.exporterSecret)
+	es.exporterSecret = nil
+	erase(es.config.LengthKey)
+	es.config.LengthKey = nil
+	es.lock.Unlock()
 
+	var err error
 	if stream, ok := es.stream.(io.Closer); ok {
-		return stream.Close()
+		err = stream.Close()
 	}
 
-	es.isClosed = true
+	es.destroyRekeyState()
 
-	return nil
+	for _, destroy := range []func() error{es.tryDestroyRead, es.tryDestroyWrite} {
+		if e := destroy(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// PeerStaticKey returns the static public key of the peer authenticated by
+// NoiseHandshake, or nil if the stream is not created by NoiseHandshake. When
+// using NoiseIK, it is the responder's static key known before handshake on
+// initiator side.
+func (es *EncryptedStream) PeerStaticKey() []byte {
+	return es.peerStaticKey
+}
+
+// PeerPublicKey returns the Ed25519 public key of the peer authenticated by
+// Handshake or NKNHandshake, or nil if the stream is not created by Handshake
+// with HandshakeConfig.PrivateKey set or by NKNHandshake. Application can use
+// it to authorize the peer after the stream is established.
+func (es *EncryptedStream) PeerPublicKey() ed25519.PublicKey {
+	return es.peerPublicKey
+}
+
+// PeerAttributes returns the attributes of peer's credential verified by
+// Handshake with HandshakeConfig.TrustRoots, or nil if peer's credential is not
+// verified.
+func (es *EncryptedStream) PeerAttributes() map[string]string {
+	return es.peerAttributes
+}
+
+// CipherSuite returns the cipher suite of a stream created by a handshake, or
+// zero if the stream is created by NewEncryptedStream with a custom cipher.
+func (es *EncryptedStream) CipherSuite() CipherSuite {
+	return es.cipherSuite
+}
+
+// Resumed returns whether the stream is created by Handshake that resumed a
+// previous session using a session ticket.
+func (es *EncryptedStream) Resumed() bool {
+	return es.resumed
+}
+
+// SessionTicket returns the session ticket issued by responder during Handshake
+// on initiator side, or nil if no ticket is issued. It can be set as
+// HandshakeConfig.SessionTicket of a later handshake with the same responder to
+// resume the session. It contains secret used to derive session keys, so it
+// should be stored securely.
+func (es *EncryptedStream) SessionTicket() []byte {
+	return es.sessionTicket
 }
 
 // LocalAddr implements net.Conn. Will call underlying stream's LocalAddr()
@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite identifies the cipher of an encrypted stream created by a
+// handshake. Its numeric value is sent over the wire during negotiation, so
+// it should never be changed.
+type CipherSuite uint16
+
+const (
+	// CipherSuiteXSalsa20Poly1305 uses XSalsa20Poly1305Cipher.
+	CipherSuiteXSalsa20Poly1305 CipherSuite = 0x0001
+
+	// CipherSuiteAES128GCM uses AES-128 in Galois Counter Mode.
+	CipherSuiteAES128GCM CipherSuite = 0x0002
+
+	// CipherSuiteAES256GCM uses AES-256 in Galois Counter Mode.
+	CipherSuiteAES256GCM CipherSuite = 0x0003
+
+	// CipherSuiteChaCha20Poly1305 uses ChaCha20-Poly1305 (RFC 8439).
+	CipherSuiteChaCha20Poly1305 CipherSuite = 0x0004
+
+	// CipherSuiteXChaCha20Poly1305 uses XChaCha20-Poly1305.
+	CipherSuiteXChaCha20Poly1305 CipherSuite = 0x0005
+)
+
+// ErrNoCommonCipherSuite is returned by Handshake on both sides when responder
+// does not support any cipher suite offered by initiator.
+var ErrNoCommonCipherSuite = errors.New("no common cipher suite")
+
+// DefaultCipherSuites returns the cipher suites used when
+// HandshakeConfig.CipherSuites is empty, in order of preference.
+func DefaultCipherSuites() []CipherSuite {
+	return []CipherSuite{
+		CipherSuiteChaCha20Poly1305,
+		CipherSuiteAES256GCM,
+		CipherSuiteAES128GCM,
+		CipherSuiteXChaCha20Poly1305,
+		CipherSuiteXSalsa20Poly1305,
+	}
+}
+
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherSuiteXSalsa20Poly1305:
+		return "XSalsa20-Poly1305"
+	case CipherSuiteAES128GCM:
+		return "AES-128-GCM"
+	case CipherSuiteAES256GCM:
+		return "AES-256-GCM"
+	case CipherSuiteChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case CipherSuiteXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	default:
+		return fmt.Sprintf("CipherSuite(0x%04x)", uint16(s))
+	}
+}
+
+// KeySize returns the key size in bytes of the cipher suite, or 0 if the
+// cipher suite is unknown.
+func (s CipherSuite) KeySize() int {
+	switch s {
+	case CipherSuiteAES128GCM:
+		return 16
+	case CipherSuiteXSalsa20Poly1305, CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305, CipherSuiteXChaCha20Poly1305:
+		return chacha20poly1305.KeySize
+	default:
+		return 0
+	}
+}
+
+// supportsAdditionalData returns whether the cipher of the cipher suite
+// implements AdditionalDataCipher.
+func (s CipherSuite) supportsAdditionalData() bool {
+	switch s {
+	case CipherSuiteAES128GCM, CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305, CipherSuiteXChaCha20Poly1305:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewCipher creates a cipher of the cipher suite with the given key, which
+// should be KeySize bytes.
+func (s CipherSuite) NewCipher(key []byte) (Cipher, error) {
+	if s.KeySize() == 0 {
+		return nil, fmt.Errorf("unknown cipher suite %v", s)
+	}
+
+	if len(key) != s.KeySize() {
+		return nil, fmt.Errorf("%v key should be %d bytes", s, s.KeySize())
+	}
+
+	switch s {
+	case CipherSuiteXSalsa20Poly1305:
+		var k [32]byte
+		copy(k[:], key)
+		return NewXSalsa20Poly1305Cipher(&k), nil
+	case CipherSuiteAES128GCM, CipherSuiteAES256GCM:
+		return NewAESGCMCipher(key)
+	case CipherSuiteChaCha20Poly1305:
+		return NewChaCha20Poly1305Cipher(key)
+	default:
+		return NewXChaCha20Poly1305Cipher(key)
+	}
+}
+
+// marshalCipherSuites encodes cipher suites as 2 bytes little-endian each.
+func marshalCipherSuites(suites []CipherSuite) []byte {
+	b := make([]byte, 2*len(suites))
+	for i, s := range suites {
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(s))
+	}
+	return b
+}
+
+// unmarshalCipherSuites decodes bytes encoded by marshalCipherSuites.
+func unmarshalCipherSuites(b []byte) ([]CipherSuite, error) {
+	if len(b)%2 != 0 {
+		return nil, errors.New("invalid cipher suites")
+	}
+
+	suites := make([]CipherSuite, len(b)/2)
+	for i := range suites {
+		suites[i] = CipherSuite(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+
+	return suites, nil
+}
+
+// selectCipherSuite returns the first cipher suite in local preference that is
+// also offered by peer.
+func selectCipherSuite(preference, offered []CipherSuite) (CipherSuite, error) {
+	for _, s := range preference {
+		for _, o := range offered {
+			if s == o {
+				return s, nil
+			}
+		}
+	}
+	return 0, ErrNoCommonCipherSuite
+}
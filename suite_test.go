@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandshakeCipherSuite(t *testing.T) {
+	for _, suite := range DefaultCipherSuites() {
+		t.Run(suite.String(), func(t *testing.T) {
+			alice, bob, err := createPipe(false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			aliceEncrypted, bobEncrypted, err := handshakePair(
+				alice,
+				bob,
+				handshake(HandshakeConfig{Initiator: true}),
+				handshake(HandshakeConfig{CipherSuites: []CipherSuite{suite}}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if aliceEncrypted.CipherSuite() != suite || bobEncrypted.CipherSuite() != suite {
+				t.Fatalf("expect cipher suite %v, got %v and %v", suite, aliceEncrypted.CipherSuite(), bobEncrypted.CipherSuite())
+			}
+
+			err = readWriteTest(aliceEncrypted, bobEncrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHandshakeCipherSuitePreference(t *testing.T) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(
+		alice,
+		bob,
+		handshake(HandshakeConfig{Initiator: true, CipherSuites: []CipherSuite{CipherSuiteAES128GCM, CipherSuiteXChaCha20Poly1305}}),
+		handshake(HandshakeConfig{CipherSuites: []CipherSuite{CipherSuiteXChaCha20Poly1305, CipherSuiteAES128GCM}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aliceEncrypted.CipherSuite() != CipherSuiteXChaCha20Poly1305 || bobEncrypted.CipherSuite() != CipherSuiteXChaCha20Poly1305 {
+		t.Fatal("responder preference should be used")
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeNoCommonCipherSuite(t *testing.T) {
+	alice, bob := net.Pipe()
+
+	type result struct {
+		err error
+	}
+	bobChan := make(chan result, 1)
+	go func() {
+		_, err := Handshake(bob, &HandshakeConfig{CipherSuites: []CipherSuite{CipherSuiteAES256GCM}})
+		bobChan <- result{err}
+	}()
+
+	_, err := Handshake(alice, &HandshakeConfig{Initiator: true, CipherSuites: []CipherSuite{CipherSuiteChaCha20Poly1305}})
+	alice.Close()
+	if err != ErrNoCommonCipherSuite {
+		t.Fatalf("expect error %v, got %v", ErrNoCommonCipherSuite, err)
+	}
+
+	if r := <-bobChan; r.err != ErrNoCommonCipherSuite {
+		t.Fatalf("expect error %v, got %v", ErrNoCommonCipherSuite, r.err)
+	}
+}
+
+func TestHandshakeUnknownCipherSuite(t *testing.T) {
+	alice, _ := net.Pipe()
+
+	_, err := Handshake(alice, &HandshakeConfig{Initiator: true, CipherSuites: []CipherSuite{0xffff}})
+	if err == nil {
+		t.Fatal("handshake with unknown cipher suite should fail")
+	}
+}
+
+func TestHandshakeCipherSuiteAdditionalData(t *testing.T) {
+	for _, config := range []*Config{{AuthenticateHeader: true}, {EncryptLength: true}} {
+		alice, bob, err := createPipe(false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// XSalsa20-Poly1305 is preferred by both sides, but does not support
+		// additional data.
+		suites := []CipherSuite{CipherSuiteXSalsa20Poly1305, CipherSuiteChaCha20Poly1305}
+		aliceEncrypted, bobEncrypted, err := handshakePair(
+			alice,
+			bob,
+			handshake(HandshakeConfig{Initiator: true, CipherSuites: suites, Config: config}),
+			handshake(HandshakeConfig{CipherSuites: suites, Config: config}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if aliceEncrypted.CipherSuite() != CipherSuiteChaCha20Poly1305 || bobEncrypted.CipherSuite() != CipherSuiteChaCha20Poly1305 {
+			t.Fatalf("expect cipher suite %v, got %v and %v", CipherSuiteChaCha20Poly1305, aliceEncrypted.CipherSuite(), bobEncrypted.CipherSuite())
+		}
+
+		err = readWriteTest(aliceEncrypted, bobEncrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice, _ := net.Pipe()
+
+	_, err := Handshake(alice, &HandshakeConfig{Initiator: true, CipherSuites: []CipherSuite{CipherSuiteXSalsa20Poly1305}, Config: &Config{AuthenticateHeader: true}})
+	if err != ErrAdditionalDataNotSupported {
+		t.Fatalf("expect error %v, got %v", ErrAdditionalDataNotSupported, err)
+	}
+}
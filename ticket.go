@@ -0,0 +1,285 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// DefaultSessionTicketLifetime is the default lifetime of session tickets.
+	DefaultSessionTicketLifetime = 24 * time.Hour
+
+	// maxSessionTicketKeys is the max number of ticket keys kept by
+	// SessionTicketKeys. Tickets sealed by older keys can no longer be opened.
+	maxSessionTicketKeys = 3
+
+	// sessionTicketKeyIDSize is the size of ticket key identifier prepended to
+	// each ticket.
+	sessionTicketKeyIDSize = 8
+)
+
+var errInvalidSessionTicket = errors.New("invalid session ticket")
+
+// SessionTicketKeys holds the keys used by Handshake responder to seal and open
+// session tickets, together with the ticket policy. It is safe for concurrent
+// use, and should be shared by all handshakes of a responder. Tickets sealed by
+// a key are accepted until the key is rotated out (see Rotate) or the ticket
+// lifetime is reached, whichever comes first. The zero value is usable, with a
+// random ticket key generated on first use, DefaultSessionTicketLifetime and
+// tickets that can be used more than once.
+type SessionTicketKeys struct {
+	lifetime  time.Duration
+	singleUse bool
+
+	lock        sync.Mutex
+	keys        []*sessionTicketKey
+	usedTickets map[[sha256.Size]byte]time.Time
+}
+
+type sessionTicketKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// NewSessionTicketKeys creates a SessionTicketKeys with a random ticket key.
+// Tickets expire after lifetime (DefaultSessionTicketLifetime if zero). If
+// singleUse is true, each ticket can only be used to resume once, which
+// prevents replayed resumptions at the cost of remembering used tickets until
+// they expire.
+func NewSessionTicketKeys(lifetime time.Duration, singleUse bool) (*SessionTicketKeys, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultSessionTicketLifetime
+	}
+
+	k := &SessionTicketKeys{
+		lifetime:  lifetime,
+		singleUse: singleUse,
+	}
+
+	err := k.Rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Rotate generates a new random ticket key that will be used to seal new
+// tickets. Previous keys are kept to open existing tickets, until there are
+// more than a few keys. Rotate should be called periodically, e.g. once per
+// ticket lifetime.
+func (k *SessionTicketKeys) Rotate() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.addRandomKey()
+}
+
+// SetKeys replaces all ticket keys with the given 32 bytes keys. The first one
+// will be used to seal new tickets, and all of them can be used to open
+// tickets. It can be used to share ticket keys among multiple responders.
+func (k *SessionTicketKeys) SetKeys(keys ...[]byte) error {
+	if len(keys) == 0 {
+		return errors.New("no session ticket key")
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.keys = nil
+	for i := len(keys) - 1; i >= 0; i-- {
+		err := k.addKey(keys[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (k *SessionTicketKeys) addRandomKey() error {
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	defer erase(key)
+
+	return k.addKey(key)
+}
+
+func (k *SessionTicketKeys) addKey(key []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+
+	id := sha256.Sum256(key)
+	k.keys = append([]*sessionTicketKey{{id: id[:sessionTicketKeyIDSize], aead: aead}}, k.keys...)
+	if len(k.keys) > maxSessionTicketKeys {
+		k.keys = k.keys[:maxSessionTicketKeys]
+	}
+
+	return nil
+}
+
+// sessionTicketState is the session state sealed in a session ticket.
+type sessionTicketState struct {
+	issued           time.Time
+	resumptionSecret []byte
+	peerPublicKey    ed25519.PublicKey
+	peerCredentials  []byte
+}
+
+// ticketLifetime returns the lifetime of tickets, which is
+// DefaultSessionTicketLifetime for the zero value.
+func (k *SessionTicketKeys) ticketLifetime() time.Duration {
+	if k.lifetime == 0 {
+		return DefaultSessionTicketLifetime
+	}
+	return k.lifetime
+}
+
+// seal encrypts a session state into a ticket using the current ticket key. A
+// random ticket key is generated if there is none yet.
+func (k *SessionTicketKeys) seal(state *sessionTicketState) ([]byte, error) {
+	k.lock.Lock()
+	if len(k.keys) == 0 {
+		err := k.addRandomKey()
+		if err != nil {
+			k.lock.Unlock()
+			return nil, err
+		}
+	}
+	key := k.keys[0]
+	k.lock.Unlock()
+
+	var issued [8]byte
+	binary.LittleEndian.PutUint64(issued[:], uint64(state.issued.Unix()))
+	plaintext, err := marshalFields(issued[:], state.resumptionSecret, state.peerPublicKey, state.peerCredentials)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket := make([]byte, sessionTicketKeyIDSize+key.aead.NonceSize(), sessionTicketKeyIDSize+key.aead.NonceSize()+len(plaintext)+key.aead.Overhead())
+	copy(ticket, key.id)
+	_, err = rand.Read(ticket[sessionTicketKeyIDSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return key.aead.Seal(ticket, ticket[sessionTicketKeyIDSize:], plaintext, ticket[:sessionTicketKeyIDSize]), nil
+}
+
+// open decrypts a ticket and returns its session state. Returns error if the
+// ticket is invalid, expired, or has been used and tickets are single use.
+func (k *SessionTicketKeys) open(ticket []byte) (*sessionTicketState, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	var key *sessionTicketKey
+	for _, kk := range k.keys {
+		if len(ticket) >= sessionTicketKeyIDSize && string(kk.id) == string(ticket[:sessionTicketKeyIDSize]) {
+			key = kk
+			break
+		}
+	}
+	if key == nil {
+		return nil, errInvalidSessionTicket
+	}
+
+	if len(ticket) < sessionTicketKeyIDSize+key.aead.NonceSize() {
+		return nil, errInvalidSessionTicket
+	}
+
+	nonce := ticket[sessionTicketKeyIDSize : sessionTicketKeyIDSize+key.aead.NonceSize()]
+	plaintext, err := key.aead.Open(nil, nonce, ticket[sessionTicketKeyIDSize+key.aead.NonceSize():], ticket[:sessionTicketKeyIDSize])
+	if err != nil {
+		return nil, errInvalidSessionTicket
+	}
+
+	fields, err := unmarshalFields(plaintext)
+	if err != nil || len(fields) != 4 || len(fields[0]) != 8 {
+		return nil, errInvalidSessionTicket
+	}
+
+	state := &sessionTicketState{
+		issued:           time.Unix(int64(binary.LittleEndian.Uint64(fields[0])), 0),
+		resumptionSecret: fields[1],
+		peerCredentials:  fields[3],
+	}
+	if len(fields[2]) > 0 {
+		state.peerPublicKey = ed25519.PublicKey(fields[2])
+	}
+
+	now := time.Now()
+	expiry := state.issued.Add(k.ticketLifetime())
+	if now.After(expiry) {
+		return nil, errors.New("session ticket expired")
+	}
+
+	if k.singleUse {
+		for id, t := range k.usedTickets {
+			if now.After(t) {
+				delete(k.usedTickets, id)
+			}
+		}
+
+		id := sha256.Sum256(ticket)
+		if _, ok := k.usedTickets[id]; ok {
+			return nil, errors.New("session ticket has been used")
+		}
+		if k.usedTickets == nil {
+			k.usedTickets = make(map[[sha256.Size]byte]time.Time)
+		}
+		k.usedTickets[id] = expiry
+	}
+
+	return state, nil
+}
+
+// clientSession is the session state stored by initiator to resume a session.
+type clientSession struct {
+	ticket           []byte
+	resumptionSecret []byte
+	peerPublicKey    ed25519.PublicKey
+	peerCredentials  []byte
+	expiry           time.Time
+}
+
+func (s *clientSession) marshal() ([]byte, error) {
+	var expiry [8]byte
+	binary.LittleEndian.PutUint64(expiry[:], uint64(s.expiry.Unix()))
+	return marshalFields(s.ticket, s.resumptionSecret, s.peerPublicKey, expiry[:], s.peerCredentials)
+}
+
+func unmarshalClientSession(b []byte) (*clientSession, error) {
+	fields, err := unmarshalFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) != 5 || len(fields[3]) != 8 {
+		return nil, errInvalidSessionTicket
+	}
+
+	s := &clientSession{
+		ticket:           fields[0],
+		resumptionSecret: fields[1],
+		expiry:           time.Unix(int64(binary.LittleEndian.Uint64(fields[3])), 0),
+		peerCredentials:  fields[4],
+	}
+	if len(fields[2]) > 0 {
+		s.peerPublicKey = ed25519.PublicKey(fields[2])
+	}
+
+	return s, nil
+}
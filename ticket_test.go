@@ -0,0 +1,181 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func ticketHandshake(t *testing.T, initiatorConfig, responderConfig HandshakeConfig) (*EncryptedStream, *EncryptedStream) {
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiatorConfig.Initiator = true
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, handshake(initiatorConfig), handshake(responderConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return aliceEncrypted, bobEncrypted
+}
+
+func TestHandshakeSessionTicket(t *testing.T) {
+	ticketKeys, err := NewSessionTicketKeys(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted := ticketHandshake(t, HandshakeConfig{}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+	if aliceEncrypted.Resumed() || bobEncrypted.Resumed() {
+		t.Fatal("first handshake should not be resumed")
+	}
+
+	ticket := aliceEncrypted.SessionTicket()
+	if len(ticket) == 0 {
+		t.Fatal("initiator should get a session ticket")
+	}
+
+	if bobEncrypted.SessionTicket() != nil {
+		t.Fatal("responder should not get a session ticket")
+	}
+
+	for i := 0; i < 2; i++ {
+		aliceEncrypted, bobEncrypted = ticketHandshake(t, HandshakeConfig{SessionTicket: ticket}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+		if !aliceEncrypted.Resumed() || !bobEncrypted.Resumed() {
+			t.Fatal("handshake with session ticket should be resumed")
+		}
+
+		if len(aliceEncrypted.SessionTicket()) == 0 {
+			t.Fatal("initiator should get a new session ticket")
+		}
+	}
+}
+
+func TestHandshakeSessionTicketZeroValue(t *testing.T) {
+	ticketKeys := &SessionTicketKeys{}
+
+	aliceEncrypted, _ := ticketHandshake(t, HandshakeConfig{}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+
+	ticket := aliceEncrypted.SessionTicket()
+	if len(ticket) == 0 {
+		t.Fatal("initiator should get a session ticket")
+	}
+
+	aliceEncrypted, bobEncrypted := ticketHandshake(t, HandshakeConfig{SessionTicket: ticket}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+	if !aliceEncrypted.Resumed() || !bobEncrypted.Resumed() {
+		t.Fatal("handshake with session ticket should be resumed")
+	}
+}
+
+func TestHandshakeSessionTicketEd25519(t *testing.T) {
+	alicePub, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPub, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticketKeys, err := NewSessionTicketKeys(time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, _ := ticketHandshake(t, HandshakeConfig{PrivateKey: aliceKey}, HandshakeConfig{PrivateKey: bobKey, SessionTicketKeys: ticketKeys})
+	ticket := aliceEncrypted.SessionTicket()
+
+	aliceEncrypted, bobEncrypted := ticketHandshake(t, HandshakeConfig{PrivateKey: aliceKey, SessionTicket: ticket}, HandshakeConfig{PrivateKey: bobKey, SessionTicketKeys: ticketKeys})
+	if !aliceEncrypted.Resumed() || !bobEncrypted.Resumed() {
+		t.Fatal("handshake with session ticket should be resumed")
+	}
+
+	if !bytes.Equal(aliceEncrypted.PeerPublicKey(), bobPub) {
+		t.Fatal("alice got wrong peer public key")
+	}
+
+	if !bytes.Equal(bobEncrypted.PeerPublicKey(), alicePub) {
+		t.Fatal("bob got wrong peer public key")
+	}
+
+	// Single use ticket should fall back to full handshake when reused.
+	aliceEncrypted, bobEncrypted = ticketHandshake(t, HandshakeConfig{PrivateKey: aliceKey, SessionTicket: ticket}, HandshakeConfig{PrivateKey: bobKey, SessionTicketKeys: ticketKeys})
+	if aliceEncrypted.Resumed() || bobEncrypted.Resumed() {
+		t.Fatal("reused single use ticket should not be resumed")
+	}
+}
+
+func TestHandshakeSessionTicketExpired(t *testing.T) {
+	ticketKeys, err := NewSessionTicketKeys(time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, _ := ticketHandshake(t, HandshakeConfig{}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+	session, err := unmarshalClientSession(aliceEncrypted.SessionTicket())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticket, err := session.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ticket expired on responder side but not on initiator side.
+	ticketKeys.lifetime = -time.Second
+	aliceEncrypted, bobEncrypted := ticketHandshake(t, HandshakeConfig{SessionTicket: ticket}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+	if aliceEncrypted.Resumed() || bobEncrypted.Resumed() {
+		t.Fatal("expired ticket should not be resumed")
+	}
+
+	// Ticket expired on initiator side.
+	ticketKeys.lifetime = time.Hour
+	session.expiry = time.Now().Add(-time.Second)
+	ticket, err = session.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, bobEncrypted = ticketHandshake(t, HandshakeConfig{SessionTicket: ticket}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+	if aliceEncrypted.Resumed() || bobEncrypted.Resumed() {
+		t.Fatal("expired ticket should not be resumed")
+	}
+}
+
+func TestHandshakeSessionTicketRotate(t *testing.T) {
+	ticketKeys, err := NewSessionTicketKeys(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted, _ := ticketHandshake(t, HandshakeConfig{}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+	ticket := aliceEncrypted.SessionTicket()
+
+	for i := 0; i < maxSessionTicketKeys; i++ {
+		aliceEncrypted, bobEncrypted := ticketHandshake(t, HandshakeConfig{SessionTicket: ticket}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+		if !aliceEncrypted.Resumed() || !bobEncrypted.Resumed() {
+			t.Fatalf("ticket should be resumed after %d rotations", i)
+		}
+
+		err = ticketKeys.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aliceEncrypted, bobEncrypted := ticketHandshake(t, HandshakeConfig{SessionTicket: ticket}, HandshakeConfig{SessionTicketKeys: ticketKeys})
+	if aliceEncrypted.Resumed() || bobEncrypted.Resumed() {
+		t.Fatal("ticket sealed by rotated out key should not be resumed")
+	}
+}
@@ -0,0 +1,118 @@
+package stream
+
+import "fmt"
+
+// UsageLimitAction is the action to take when a usage limit of a key is
+// reached.
+type UsageLimitAction int
+
+const (
+	// UsageLimitActionError makes Write return *UsageLimitError when a usage
+	// limit is reached. It is the default action.
+	UsageLimitActionError UsageLimitAction = iota
+
+	// UsageLimitActionKeyUpdate updates the encryption key before a usage limit
+	// is reached. It requires Config.KeyUpdate to be true.
+	UsageLimitActionKeyUpdate
+)
+
+// usageLimitReserve is the number of control frames that can be sent after
+// key update is triggered by usage limit.
+const usageLimitReserve = 4
+
+// UsageLimits are the limits of using a single key, beyond which the security
+// of the AEAD can no longer be guaranteed. Zero means no limit.
+type UsageLimits struct {
+	// MaxChunks is the max number of chunks encrypted with the key, e.g. 2^32
+	// for AEAD with 96-bit random nonce to keep the probability of nonce
+	// collision negligible.
+	MaxChunks uint64
+
+	// MaxBytes is the max number of plaintext bytes encrypted with the key.
+	MaxBytes uint64
+
+	// MaxFailedDecryptions is the max number of failed decryptions with the key,
+	// beyond which the probability of a successful forgery is no longer
+	// negligible.
+	MaxFailedDecryptions uint64
+}
+
+// UsageLimiter is an optional interface that can be implemented by Cipher to
+// provide the usage limits of its key, which are enforced by Encoder and
+// Decoder. All ciphers in this package implement it.
+type UsageLimiter interface {
+	// UsageLimits returns the usage limits of the key when nonces are
+	// sequential or random.
+	UsageLimits(sequentialNonce bool) UsageLimits
+}
+
+// UsageLimitError is returned by Encoder and Decoder when a usage limit of the
+// current key is reached. The stream should be rekeyed (see Config.KeyUpdate)
+// or closed.
+type UsageLimitError struct {
+	// Limit is the name of the reached limit in UsageLimits.
+	Limit string
+
+	// Value is the value of the reached limit.
+	Value uint64
+}
+
+func (e *UsageLimitError) Error() string {
+	return fmt.Sprintf("key usage limit %s (%d) reached", e.Limit, e.Value)
+}
+
+var (
+	// aesGCMUsageLimits follows NIST SP 800-38D for random nonces and RFC 9001
+	// for confidentiality and integrity limits. RFC 9001 states them in
+	// packets: 2^23 encrypted packets of up to 2^16 bytes, derived from a
+	// bound of 2^35 blocks encrypted in total, and 2^52 forged packets. As
+	// chunk size varies, MaxBytes enforces the bound on blocks in bytes, with
+	// a factor of two margin for partial blocks and per-chunk overhead.
+	aesGCMUsageLimits = UsageLimits{
+		MaxChunks:            1 << 32,
+		MaxBytes:             1 << 38,
+		MaxFailedDecryptions: 1 << 52,
+	}
+
+	// chaCha20Poly1305UsageLimits follows RFC 9001 for integrity limit.
+	chaCha20Poly1305UsageLimits = UsageLimits{
+		MaxChunks:            1 << 32,
+		MaxFailedDecryptions: 1 << 36,
+	}
+
+	// extendedNonceUsageLimits are the limits of ciphers with 192-bit nonce,
+	// whose random nonces do not collide in practice.
+	extendedNonceUsageLimits = UsageLimits{
+		MaxFailedDecryptions: 1 << 36,
+	}
+)
+
+// defaultUsageLimits returns the usage limits of an AEAD whose algorithm is
+// unknown, based on its nonce size.
+func defaultUsageLimits(nonceSize int) UsageLimits {
+	if nonceSize <= 12 {
+		return chaCha20Poly1305UsageLimits
+	}
+	return extendedNonceUsageLimits
+}
+
+// usageLimits returns the usage limits of a cipher, or no limit if it does not
+// implement UsageLimiter.
+func usageLimits(cipher Cipher, sequentialNonce bool) UsageLimits {
+	if limiter, ok := cipher.(UsageLimiter); ok {
+		return limiter.UsageLimits(sequentialNonce)
+	}
+	return UsageLimits{}
+}
+
+// checkUsage returns *UsageLimitError if encrypting another chunks chunks of
+// total bytes size after used chunks and bytes exceeds the limits.
+func (limits *UsageLimits) checkUsage(usedChunks, usedBytes, chunks, bytes uint64) error {
+	if limits.MaxChunks > 0 && usedChunks+chunks > limits.MaxChunks {
+		return &UsageLimitError{Limit: "MaxChunks", Value: limits.MaxChunks}
+	}
+	if limits.MaxBytes > 0 && usedBytes+bytes > limits.MaxBytes {
+		return &UsageLimitError{Limit: "MaxBytes", Value: limits.MaxBytes}
+	}
+	return nil
+}
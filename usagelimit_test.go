@@ -0,0 +1,191 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUsageLimits(t *testing.T) {
+	aesgcm, err := NewAESGCMCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aesgcm.UsageLimits(false).MaxChunks != 1<<32 {
+		t.Fatal("AES-GCM with random nonce should limit chunks to 2^32")
+	}
+
+	if limits := aesgcm.UsageLimits(true); limits.MaxChunks != 0 || limits.MaxBytes != 1<<38 || limits.MaxFailedDecryptions != 1<<52 {
+		t.Fatalf("AES-GCM with sequential nonce should only not limit chunks, got %+v", limits)
+	}
+
+	xchacha, err := NewXChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if xchacha.UsageLimits(false).MaxChunks != 0 {
+		t.Fatal("XChaCha20-Poly1305 should not limit chunks")
+	}
+}
+
+func TestEncoderUsageLimits(t *testing.T) {
+	cipher, err := NewAESGCMCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limits := range []UsageLimits{{MaxChunks: 3}, {MaxBytes: 300}} {
+		encoder, err := NewEncoder(cipher, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder.limits = limits
+
+		for i := 0; i < 3; i++ {
+			_, err = encoder.Encode(make([]byte, 256), make([]byte, 100))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var limitErr *UsageLimitError
+		_, err = encoder.Encode(make([]byte, 256), make([]byte, 100))
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("expect *UsageLimitError, got %v", err)
+		}
+	}
+}
+
+func TestDecoderUsageLimits(t *testing.T) {
+	cipher, err := NewChaCha20Poly1305Cipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoder, err := NewEncoder(cipher, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err := NewDecoder(cipher, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.limits = UsageLimits{MaxFailedDecryptions: 2}
+
+	ciphertext, err := encoder.Encode(make([]byte, 256), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := append([]byte(nil), ciphertext...)
+	forged[len(forged)-1] ^= 1
+	for i := 0; i < 2; i++ {
+		_, err = decoder.Decode(make([]byte, 256), forged)
+		if err == nil {
+			t.Fatal("forged chunk should not be decrypted")
+		}
+	}
+
+	var limitErr *UsageLimitError
+	_, err = decoder.Decode(make([]byte, 256), ciphertext)
+	if !errors.As(err, &limitErr) || limitErr.Limit != "MaxFailedDecryptions" {
+		t.Fatalf("expect *UsageLimitError, got %v", err)
+	}
+}
+
+func TestUsageLimitAction(t *testing.T) {
+	cipher, err := NewAESGCMCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []UsageLimitAction{UsageLimitActionError, UsageLimitActionKeyUpdate} {
+		alice, bob, err := createPipe(false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := Config{Cipher: cipher, MaxChunkSize: 1024, KeyUpdate: true, UsageLimitAction: action}
+		aliceConfig := config
+		aliceConfig.Initiator = true
+
+		aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, newStream(aliceConfig), newStream(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aliceEncrypted.encoder.limits = UsageLimits{MaxChunks: 100}
+
+		if action == UsageLimitActionKeyUpdate {
+			err = readWriteTest(aliceEncrypted, bobEncrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if aliceEncrypted.RekeyState().EncryptionKeyUpdates == 0 {
+				t.Fatal("key should be updated before usage limit is reached")
+			}
+			continue
+		}
+
+		go func() {
+			for {
+				_, err := bobEncrypted.Read(make([]byte, 1024))
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		var limitErr *UsageLimitError
+		_, err = aliceEncrypted.Write(make([]byte, 1<<20))
+		if !errors.As(err, &limitErr) || limitErr.Limit != "MaxChunks" {
+			t.Fatalf("expect *UsageLimitError, got %v", err)
+		}
+		aliceEncrypted.Close()
+	}
+}
+
+func TestSequentialNonceUsageLimits(t *testing.T) {
+	cipher, err := NewAESGCMCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, err := createPipe(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{Cipher: cipher, SequentialNonce: true}
+	aliceConfig := config
+	aliceConfig.Initiator = true
+
+	aliceEncrypted, bobEncrypted, err := handshakePair(alice, bob, newStream(aliceConfig), newStream(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AES-GCM with sequential nonce is not limited to 2^32 chunks, but byte and
+	// failed decryption limits still apply.
+	for _, limits := range []UsageLimits{aliceEncrypted.encoder.limits, aliceEncrypted.decoder.limits, bobEncrypted.encoder.limits, bobEncrypted.decoder.limits} {
+		if limits.MaxChunks != 0 || limits.MaxBytes != aesGCMUsageLimits.MaxBytes || limits.MaxFailedDecryptions != aesGCMUsageLimits.MaxFailedDecryptions {
+			t.Fatalf("expect only chunks not limited with sequential nonce, got %+v", limits)
+		}
+	}
+
+	aliceEncrypted.encoder.sealedChunks = aesGCMUsageLimits.MaxChunks
+
+	err = readWriteTest(aliceEncrypted, bobEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEncrypted.encoder.sealedBytes = aesGCMUsageLimits.MaxBytes
+
+	_, err = aliceEncrypted.encoder.Encode(make([]byte, 128), []byte("hello"))
+	if e, ok := err.(*UsageLimitError); !ok || e.Limit != "MaxBytes" {
+		t.Fatalf("expect MaxBytes usage limit error, got %v", err)
+	}
+}